@@ -0,0 +1,261 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	default_near        = "_agent"
+	default_max_backoff = time.Second
+	min_backoff         = 10 * time.Millisecond
+)
+
+// init registers the built-in resolver for "consul://" targets
+func init() {
+	resolver.Register(&builder{})
+}
+
+// builder implements resolver.Builder for the "consul" scheme.
+// Address, credentials and token are taken from the target
+// and fall back to the ones of the builder.
+// Resolvers watch the health endpoint with blocking queries (WaitIndex), so a change
+// of the instance set (e.g. a new canary) is pushed to gRPC by UpdateState as soon as
+// consul answers the query, without waiting for a refresh or a connection failure.
+type builder struct {
+	host    string
+	user    *url.Userinfo
+	token   string
+	headers http.Header
+	// called with the addresses before they are pushed to gRPC, nil for none
+	onUpdate func(addrs []string)
+}
+
+// RegisterResolver registers the consul resolver in the global gRPC registry
+// under the "consul" scheme with the address, auth and headers (UserAgent, Headers) of cfg baked in,
+// so targets like "consul:///my-service" are resolved by this consul.
+// Host, credentials and token given in the target itself take precedence.
+// Must be called at initialization time (e.g. in init or at the start of main),
+// before any gRPC connection is created.
+func RegisterResolver(cfg *ConsulConfig) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	b := &builder{
+		host:    cfg.address(),
+		token:   cfg.Token,
+		headers: cfg.headers(),
+	}
+	if cfg.User != "" && cfg.Pass != "" {
+		b.user = url.UserPassword(cfg.User, cfg.Pass)
+	}
+	resolver.Register(b)
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	u := target.URL
+	if u.Host == "" {
+		u.Host = b.host
+	}
+	if u.User == nil {
+		u.User = b.user
+	}
+	tgt, err := parseTarget(u)
+	if err != nil {
+		return nil, fmt.Errorf("wrong consul target: %w", err)
+	}
+	if tgt.token == "" {
+		tgt.token = b.token
+	}
+	client, err := newClient(tgt.consulConfig(), b.headers)
+	if err != nil {
+		return nil, fmt.Errorf("create consul client: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newWatcher(client.Health(), tgt)
+	update := stateUpdater(cc, tgt.service)
+	if b.onUpdate != nil {
+		push := update
+		update = func(addrs []string) {
+			b.onUpdate(addrs)
+			push(addrs)
+		}
+	}
+	go w.run(ctx, update)
+	return &consulResolver{watcher: w, cancel: cancel}, nil
+}
+
+// stateUpdater pushes the addresses of the watcher to gRPC
+func stateUpdater(cc resolver.ClientConn, service string) func(addrs []string) {
+	return func(addrs []string) {
+		if len(addrs) == 0 {
+			cc.ReportError(ErrServicesNotFound)
+			return
+		}
+		state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+		for _, addr := range addrs {
+			state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+		}
+		if err := cc.UpdateState(state); err != nil {
+			grpclog.Errorf("[consul resolver] update state of %q: %v", service, err)
+		}
+	}
+}
+
+func (b *builder) Scheme() string {
+	return SELF_NAME
+}
+
+// consulResolver implements resolver.Resolver, addresses are pushed by the watcher
+type consulResolver struct {
+	watcher *watcher
+	cancel  context.CancelFunc
+}
+
+// ResolveNow interrupts the current blocking query, so the instances are fetched again immediately.
+func (r *consulResolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.watcher.resolveNow()
+}
+
+func (r *consulResolver) Close() {
+	r.cancel()
+}
+
+// target is the parsed form of consul://[user:password@]host:port/service?params
+type target struct {
+	address           string
+	user              string
+	password          string
+	service           string
+	tag               string
+	healthy           bool
+	wait              time.Duration
+	insecure          bool
+	near              string
+	limit             int
+	timeout           time.Duration
+	maxBackoff        time.Duration
+	refresh           time.Duration
+	token             string
+	dc                string
+	allowStale        bool
+	requireConsistent bool
+	filter            string
+	namespace         string
+	partition         string
+	peer              string
+}
+
+func parseTarget(u url.URL) (target, error) {
+	service := strings.Trim(u.Path, "/")
+	if u.Host == "" || service == "" {
+		return target{}, fmt.Errorf("target %q must be in the format consul://[user:password@]host:port/service?params", u.String())
+	}
+	tgt, err := parseQuery(u.Query())
+	if err != nil {
+		return target{}, err
+	}
+	tgt.address = u.Host
+	tgt.service = service
+	if u.User != nil {
+		tgt.user = u.User.Username()
+		tgt.password, _ = u.User.Password()
+	}
+	return tgt, nil
+}
+
+// parseQuery decodes the query produced by targetQueryValues
+func parseQuery(query url.Values) (target, error) {
+	tgt := target{
+		tag:       query.Get("tag"),
+		near:      query.Get("near"),
+		token:     query.Get("token"),
+		dc:        query.Get("dc"),
+		filter:    query.Get("filter"),
+		namespace: query.Get("ns"),
+		partition: query.Get("partition"),
+		peer:      query.Get("peer"),
+	}
+	var err error
+	for key, value := range map[string]*bool{
+		"healthy":            &tgt.healthy,
+		"insecure":           &tgt.insecure,
+		"allow-stale":        &tgt.allowStale,
+		"require-consistent": &tgt.requireConsistent,
+	} {
+		if query.Has(key) {
+			if *value, err = strconv.ParseBool(query.Get(key)); err != nil {
+				return target{}, fmt.Errorf("parameter %s: %w", key, err)
+			}
+		}
+	}
+	for key, value := range map[string]*time.Duration{
+		"wait":        &tgt.wait,
+		"timeout":     &tgt.timeout,
+		"max-backoff": &tgt.maxBackoff,
+		"refresh":     &tgt.refresh,
+	} {
+		if query.Has(key) {
+			if *value, err = time.ParseDuration(query.Get(key)); err != nil {
+				return target{}, fmt.Errorf("parameter %s: %w", key, err)
+			}
+		}
+	}
+	if query.Has("limit") {
+		if tgt.limit, err = strconv.Atoi(query.Get("limit")); err != nil {
+			return target{}, fmt.Errorf("parameter limit: %w", err)
+		}
+	}
+	if tgt.near == "" {
+		tgt.near = default_near
+	}
+	if tgt.maxBackoff == 0 {
+		tgt.maxBackoff = default_max_backoff
+	}
+	return tgt, nil
+}
+
+func (t target) consulConfig() *api.Config {
+	cfg := api.DefaultConfig()
+	cfg.Address = t.address
+	cfg.Token = t.token
+	cfg.WaitTime = t.wait
+	cfg.TLSConfig.InsecureSkipVerify = t.insecure
+	if t.user != "" && t.password != "" {
+		cfg.HttpAuth = &api.HttpBasicAuth{
+			Username: t.user,
+			Password: t.password,
+		}
+	}
+	if t.timeout != 0 {
+		if client, err := api.NewHttpClient(cfg.Transport, cfg.TLSConfig); err == nil {
+			client.Timeout = t.timeout
+			cfg.HttpClient = client
+		}
+	}
+	return cfg
+}
+
+func (t target) queryOptions() *api.QueryOptions {
+	return &api.QueryOptions{
+		Near:              t.near,
+		WaitTime:          t.wait,
+		Datacenter:        t.dc,
+		Token:             t.token,
+		AllowStale:        t.allowStale,
+		RequireConsistent: t.requireConsistent,
+		Filter:            t.filter,
+		Namespace:         t.namespace,
+		Partition:         t.partition,
+		Peer:              t.peer,
+	}
+}
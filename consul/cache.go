@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// addressCache keeps the last successfully fetched addresses of services
+type addressCache struct {
+	maxStaleness time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedAddresses
+}
+
+type cachedAddresses struct {
+	addrs     []string
+	fetchedAt time.Time
+}
+
+func newAddressCache(maxStaleness time.Duration) *addressCache {
+	return &addressCache{
+		maxStaleness: maxStaleness,
+		entries:      make(map[string]cachedAddresses),
+	}
+}
+
+func (c *addressCache) store(serviceName string, addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[serviceName] = cachedAddresses{addrs: slices.Clone(addrs), fetchedAt: time.Now()}
+}
+
+// load returns the cached addresses unless they are older than maxStaleness
+func (c *addressCache) load(serviceName string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[serviceName]
+	if !ok || time.Since(cached.fetchedAt) > c.maxStaleness {
+		return nil, false
+	}
+	return slices.Clone(cached.addrs), true
+}
+
+func (c *addressCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
@@ -0,0 +1,123 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	CHECK_HTTP = "http"
+	CHECK_TCP  = "tcp"
+
+	default_check_interval = 10 * time.Second
+	default_check_timeout  = 5 * time.Second
+)
+
+// ExternalCheck describes a health check probing an external service at its registered address.
+type ExternalCheck struct {
+	// CHECK_HTTP or CHECK_TCP
+	Type string
+	// Scheme of the http check. Default: "http"
+	Scheme string
+	// Path of the http check, e.g. "/health"
+	Path string
+	// Default: 10s
+	Interval time.Duration
+	// Default: 5s
+	Timeout time.Duration
+}
+
+// CatalogRegister creates a service record directly in the catalog on behalf of the given node.
+// Unlike Register it does not need a local agent, so it fits external services
+// (databases, third-party endpoints) that don't run a Consul agent.
+func (r *Registry) CatalogRegister(node, serviceName, instanceID, address string, port int, tags []string) error {
+	reg, err := catalogRegistration(node, serviceName, instanceID, address, port, tags)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Load().Catalog().Register(reg, nil)
+	return err
+}
+
+// CatalogRegisterExternal is like CatalogRegister but also creates a node-side http or tcp
+// check targeting address:port, so only a reachable external service is reported as healthy.
+// Consul agents don't run catalog checks themselves, they are executed by
+// consul-esm (External Service Monitor), which must be deployed in the cluster.
+func (r *Registry) CatalogRegisterExternal(node, serviceName, instanceID, address string, port int, tags []string, check ExternalCheck) error {
+	reg, err := catalogRegistration(node, serviceName, instanceID, address, port, tags)
+	if err != nil {
+		return err
+	}
+	definition := api.HealthCheckDefinition{
+		IntervalDuration: check.Interval,
+		TimeoutDuration:  check.Timeout,
+	}
+	if definition.IntervalDuration == 0 {
+		definition.IntervalDuration = default_check_interval
+	}
+	if definition.TimeoutDuration == 0 {
+		definition.TimeoutDuration = default_check_timeout
+	}
+	hostport := net.JoinHostPort(address, strconv.Itoa(port))
+	switch check.Type {
+	case CHECK_HTTP:
+		scheme := check.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		definition.HTTP = fmt.Sprintf("%s://%s%s", scheme, hostport, check.Path)
+	case CHECK_TCP:
+		definition.TCP = hostport
+	default:
+		return fmt.Errorf("unsupported external check type %q", check.Type)
+	}
+	// external-node and external-probe mark the node for consul-esm
+	reg.NodeMeta = map[string]string{
+		"external-node":  "true",
+		"external-probe": "true",
+	}
+	reg.Check = &api.AgentCheck{
+		Node:       node,
+		CheckID:    "service:" + instanceID,
+		Name:       fmt.Sprintf("%s %s check", serviceName, check.Type),
+		Status:     api.HealthCritical,
+		ServiceID:  instanceID,
+		Definition: definition,
+	}
+	_, err = r.client.Load().Catalog().Register(reg, nil)
+	return err
+}
+
+// CatalogDeregister removes a service record registered with CatalogRegister.
+func (r *Registry) CatalogDeregister(node, instanceID string) error {
+	_, err := r.client.Load().Catalog().Deregister(
+		&api.CatalogDeregistration{
+			Node:      node,
+			ServiceID: instanceID,
+		},
+		nil,
+	)
+	return err
+}
+
+func catalogRegistration(node, serviceName, instanceID, address string, port int, tags []string) (*api.CatalogRegistration, error) {
+	cfg := ServiceConfig{Name: serviceName, Host: address, Port: port, Tags: tags}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &api.CatalogRegistration{
+		Node:    node,
+		Address: address,
+		Service: &api.AgentService{
+			ID:      instanceID,
+			Service: serviceName,
+			Address: address,
+			Port:    port,
+			Tags:    tags,
+		},
+	}, nil
+}
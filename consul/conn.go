@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/grpclog"
+)
+
+// WaitForReady starts connecting the lazily created conn and blocks until it is READY
+// or ctx is done, e.g. for a readiness probe gated on a downstream dependency.
+// The current state is available by conn.GetState(), its changes
+// can be observed with conn.WaitForStateChange in a loop.
+func WaitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("connection to %s is closed", conn.Target())
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("connection to %s is %s: %w", conn.Target(), state, ctx.Err())
+		}
+	}
+}
+
+// ManagedConn is a connection to a service with its lifetime managed as a whole:
+// changes of the connectivity state and of the resolved instances are logged with grpclog,
+// Close stops the goroutines following them and closes the connection.
+type ManagedConn struct {
+	*grpc.ClientConn
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+// ServiceConnectManaged is like ServiceConnectGRPC but returns the connection wrapped into
+// a ManagedConn, for long-lived clients. The instances logged are the ones the resolver
+// of the connection pushes to gRPC, no separate watch of consul is made.
+func (r *Registry) ServiceConnectManaged(serviceName string, opts ...OptionFunc) (*ManagedConn, error) {
+	opts = append(opts, withUpdateHook(func(addrs []string) {
+		grpclog.Infof("[consul conn] instances of %q: %v", serviceName, addrs)
+	}))
+	conn, err := r.ServiceConnectGRPC(serviceName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &ManagedConn{ClientConn: conn, cancel: cancel}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		state := conn.GetState()
+		for conn.WaitForStateChange(ctx, state) {
+			state = conn.GetState()
+			grpclog.Infof("[consul conn] connection to %q is %s", serviceName, state)
+		}
+	}()
+	return m, nil
+}
+
+// State returns the current connectivity state of the connection.
+func (m *ManagedConn) State() connectivity.State {
+	return m.GetState()
+}
+
+// Close stops following the connection and closes it. Calling Close again returns the same result.
+func (m *ManagedConn) Close() error {
+	m.once.Do(func() {
+		m.cancel()
+		m.wg.Wait()
+		m.err = m.ClientConn.Close()
+	})
+	return m.err
+}
@@ -0,0 +1,38 @@
+package consul
+
+import (
+	"testing"
+)
+
+func TestServiceConnectManagedWatchesOnce(t *testing.T) {
+	backend := startBackend(t)
+	agent := newFakeAgent(t, backend)
+	reg := agent.registry(t)
+
+	conn, err := reg.ServiceConnectManaged("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := servedBy(t, conn.ClientConn); got != backend {
+		t.Fatalf("served by %s, want %s", got, backend)
+	}
+	eventually(t, "blocking query", func() bool {
+		for _, req := range agent.healthRequests() {
+			if req.URL.Query().Get("index") == "1" {
+				return true
+			}
+		}
+		return false
+	})
+	// the instances are logged from the resolver, there is no second watch of consul
+	initial := 0
+	for _, req := range agent.healthRequests() {
+		if !req.URL.Query().Has("index") {
+			initial++
+		}
+	}
+	if initial != 1 {
+		t.Errorf("%d watches of the instances, want only the one of the resolver", initial)
+	}
+}
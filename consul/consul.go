@@ -2,38 +2,112 @@ package consul
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/hashicorp/consul/api"
 )
 
 var ErrServicesNotFound error = fmt.Errorf("no service addresses found")
 
-const (
-	SELF_NAME    = "consul"
-	default_port = 8500
-	default_host = "localhost"
+var ErrInvalidServiceConfig error = fmt.Errorf("invalid service configuration")
+
+var ErrInstanceNotFound error = fmt.Errorf("service instance not found")
+
+var ErrInstanceExists error = fmt.Errorf("service instance already registered with another address")
+
+var ErrRegistryClosed error = fmt.Errorf("registry is closed")
+
+const SELF_NAME = "consul"
+
+// Interval of the heartbeats sent to the default TTL check of the instance (see retryer.CheckHealthAndReconnect)
+const HEARTBEAT_INTERVAL = time.Second
+
+// TTL of the default check of the instance, extended by WithFailuresBeforeCritical
+const default_check_ttl = 5 * time.Second
+
+// Address of consul used by DefaultConfig, can be overridden
+// e.g. when consul doesn't run on the default port.
+var (
+	DefaultHost = "localhost"
+	DefaultPort = 8500
 )
 
 func DefaultConfig() *ConsulConfig {
 	return &ConsulConfig{
-		Host: default_host,
-		Port: default_port,
+		Host: DefaultHost,
+		Port: DefaultPort,
 	}
 }
 
 // Registry defines a Consul-based service regisry.
 type Registry struct {
-	client *api.Client
-	config *api.Config
+	// replaced by Reconnect
+	client atomic.Pointer[api.Client]
+	// config of the first client, Reconnect builds a new one from consulConfig
+	config       *api.Config
+	consulConfig *ConsulConfig
+
+	mu sync.Mutex
+	// registrations made through the registry by instanceID
+	registrations map[string]trackedRegistration
+	// Near and Limit set by SetDefaultLookupOptions
+	lookupDefaults LookupOptions
+	// nil when MaxStaleness isn't set
+	cache *addressCache
+	// nil when ReadRateLimit isn't set
+	limiter *tokenBucket
+	// nil when DNSAddress isn't set
+	dns         *net.Resolver
+	dnsDomain   string
+	dnsFallback bool
+
+	closeOnce sync.Once
+	// done when the registry is closed, stops its watches
+	closed context.Context
+	stop   context.CancelFunc
+	// releases the client shared by a RegistryFactory, nil when the registry owns its client
+	release func()
+	// transport of the current client when the registry owns it
+	transport *http.Transport
+	headers   http.Header
 }
 
 type ConsulConfig struct {
-	Host string
-	Port int
-	User string
-	Pass string
+	Host  string
+	Port  int
+	User  string
+	Pass  string
+	Token string
+	// ServiceAddresses serves the last fetched addresses up to this age
+	// when consul is unreachable or reads are rate limited. Default: 0, disabled
+	MaxStaleness time.Duration
+	// Reads of service instances allowed per second, exceeding ones fail
+	// with ErrRateLimited, a safety valve for callers hammering the agent. Default: 0, no limit
+	ReadRateLimit float64
+	// Reads allowed at once above ReadRateLimit. Default: ReadRateLimit rounded up
+	ReadBurst int
+	// host:port of the consul DNS interface used by ServiceAddressesDNS, e.g. "127.0.0.1:8600"
+	DNSAddress string
+	// Domain served by the consul DNS interface. Default: "consul"
+	DNSDomain string
+	// ServiceAddresses resolves over DNS when the HTTP API fails, requires DNSAddress. Default: false
+	DNSFallback bool
+	// User-Agent of the requests of the registry and of the resolvers of its gRPC connections
+	// to consul, e.g. the service name, so its calls can be told apart in the audit logs.
+	// Default: the one of Go
+	UserAgent string
+	// Additional headers of the requests to consul, sent by the resolvers as well
+	Headers http.Header
 }
 
 type ServiceConfig struct {
@@ -43,78 +117,756 @@ type ServiceConfig struct {
 	Tags []string
 }
 
+func (c *ConsulConfig) address() string {
+	return joinHostPort(c.Host, c.Port)
+}
+
+// headers returns the headers of the requests to consul, nil when there are none
+func (c *ConsulConfig) headers() http.Header {
+	if c == nil || c.UserAgent == "" && len(c.Headers) == 0 {
+		return nil
+	}
+	headers := c.Headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if c.UserAgent != "" {
+		headers.Set("User-Agent", c.UserAgent)
+	}
+	return headers
+}
+
+// Validate checks the service configuration and returns all found problems joined into one error,
+// which matches ErrInvalidServiceConfig.
+func (c *ServiceConfig) Validate() error {
+	if c == nil {
+		return fmt.Errorf("%w: service configuration not defined", ErrInvalidServiceConfig)
+	}
+	var errs []error
+	if strings.TrimSpace(c.Name) == "" {
+		errs = append(errs, fmt.Errorf("service name is empty"))
+	}
+	if strings.TrimSpace(c.Host) == "" {
+		errs = append(errs, fmt.Errorf("service host is empty"))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("service port %d out of range 1-65535", c.Port))
+	}
+	for i, tag := range c.Tags {
+		if strings.TrimSpace(tag) == "" {
+			errs = append(errs, fmt.Errorf("service tag #%d is empty", i))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Join(append([]error{ErrInvalidServiceConfig}, errs...)...)
+}
+
 // NewRegistry creates a new Consul-based service registry instance.
 func NewRegistry(config *ConsulConfig) (*Registry, error) {
+	cfg := apiConfig(config)
+	client, err := newClient(cfg, config.headers())
+	if err != nil {
+		return nil, err
+	}
+	r := newRegistry(config, cfg, client, nil)
+	r.transport = cfg.Transport
+	return r, nil
+}
+
+func newClient(cfg *api.Config, headers http.Header) (*api.Client, error) {
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if headers != nil {
+		client.SetHeaders(headers)
+	}
+	return client, nil
+}
+
+func apiConfig(config *ConsulConfig) *api.Config {
 	cfg := api.DefaultConfig()
 	if config != nil {
-		cfg.Address = fmt.Sprintf("%s:%d", config.Host, config.Port)
+		cfg.Address = config.address()
 		cfg.HttpAuth = &api.HttpBasicAuth{
 			Username: config.User,
 			Password: config.Pass,
 		}
+		cfg.Token = config.Token
 	}
-	client, err := api.NewClient(cfg)
+	return cfg
+}
+
+func newRegistry(config *ConsulConfig, cfg *api.Config, client *api.Client, release func()) *Registry {
+	if config != nil {
+		copied := *config
+		copied.Headers = config.Headers.Clone()
+		config = &copied
+	}
+	closed, stop := context.WithCancel(context.Background())
+	r := &Registry{
+		closed:        closed,
+		stop:          stop,
+		config:        cfg,
+		consulConfig:  config,
+		registrations: make(map[string]trackedRegistration),
+		release:       release,
+		headers:       config.headers(),
+	}
+	if config != nil && config.MaxStaleness > 0 {
+		r.cache = newAddressCache(config.MaxStaleness)
+	}
+	if config != nil && config.ReadRateLimit > 0 {
+		r.limiter = newTokenBucket(config.ReadRateLimit, config.ReadBurst)
+	}
+	if config != nil && config.DNSAddress != "" {
+		r.dns = newDNSResolver(config.DNSAddress)
+		r.dnsDomain = config.DNSDomain
+		if r.dnsDomain == "" {
+			r.dnsDomain = default_dns_domain
+		}
+		r.dnsFallback = config.DNSFallback
+	}
+	r.client.Store(client)
+	return r
+}
+
+// Close releases the connections of the registry to consul and stops its watches (WatchService),
+// the registrations are kept. The client of a registry made by a RegistryFactory is torn down
+// when its last registry is closed. Afterwards calls of the registry fail with ErrRegistryClosed,
+// the cached addresses are dropped. Calling Close again does nothing.
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		r.stop()
+		r.client.Store(closedClient(r.config.Address))
+		transport := r.transport
+		r.transport = nil
+		r.mu.Unlock()
+		if transport != nil {
+			transport.CloseIdleConnections()
+		}
+		if r.release != nil {
+			r.release()
+		}
+		if r.cache != nil {
+			r.cache.clear()
+		}
+	})
+	return nil
+}
+
+// closedClient makes a client whose requests fail with ErrRegistryClosed
+func closedClient(address string) *api.Client {
+	client, _ := api.NewClient(&api.Config{
+		Address:    address,
+		HttpClient: &http.Client{Transport: closedTransport{}},
+	})
+	return client
+}
+
+type closedTransport struct{}
+
+func (closedTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, ErrRegistryClosed
+}
+
+// isClosed reports whether Close was called
+func (r *Registry) isClosed() bool {
+	return r.closed.Err() != nil
+}
+
+// Address returns the host:port of consul the registry and the resolvers of its connections talk to.
+func (r *Registry) Address() string {
+	return r.config.Address
+}
+
+// Scheme returns the scheme ("http" or "https") of the consul API the registry talks to.
+func (r *Registry) Scheme() string {
+	return r.config.Scheme
+}
+
+// Ping checks that the consul agent is reachable and the cluster has a leader.
+func (r *Registry) Ping(ctx context.Context) error {
+	return ping(ctx, r.client.Load(), r.config.Address)
+}
+
+func ping(ctx context.Context, client *api.Client, address string) error {
+	leader, err := client.Status().LeaderWithQueryOptions((&api.QueryOptions{}).WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("ping consul %s: %w", address, err)
+	}
+	if leader == "" {
+		return fmt.Errorf("ping consul %s: no cluster leader", address)
+	}
+	return nil
+}
+
+// Reconnect replaces the consul client of the registry in place, so references to the registry
+// keep working, and registers again the instances registered through it, as the agent
+// could have lost them e.g. after a restart. The new client is built from the config
+// of the registry with its own connection pool and is used only once it answers Ping.
+func (r *Registry) Reconnect(ctx context.Context) error {
+	if r.isClosed() {
+		return ErrRegistryClosed
+	}
+	cfg := apiConfig(r.consulConfig)
+	client, err := newClient(cfg, r.headers)
+	if err != nil {
+		return err
+	}
+	if err := ping(ctx, client, cfg.Address); err != nil {
+		cfg.Transport.CloseIdleConnections()
+		return err
+	}
+	r.mu.Lock()
+	if r.isClosed() {
+		r.mu.Unlock()
+		cfg.Transport.CloseIdleConnections()
+		return ErrRegistryClosed
+	}
+	r.client.Store(client)
+	old := r.transport
+	r.transport = cfg.Transport
+	r.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+	r.mu.Lock()
+	registrations := make([]trackedRegistration, 0, len(r.registrations))
+	for _, tracked := range r.registrations {
+		registrations = append(registrations, tracked)
 	}
-	return &Registry{client: client, config: cfg}, nil
+	r.mu.Unlock()
+	var errs []error
+	for _, tracked := range registrations {
+		if err := r.register(ctx, tracked.reg, tracked.token); err != nil {
+			errs = append(errs, fmt.Errorf("register %s: %w", tracked.reg.ID, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // Register creates a service record in the registry and return instanceID
-func (r *Registry) Register(serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string) error {
-	if err := r.client.Agent().ServiceRegister(
-		&api.AgentServiceRegistration{
-			Address: serviceHost,
-			ID:      instanceID,
-			Name:    serviceName,
-			Port:    servicePort,
-			Tags:    serviceTags,
-			Check:   &api.AgentServiceCheck{CheckID: instanceID, TTL: "5s"},
-		},
-	); err != nil {
+func (r *Registry) Register(serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string, opts ...RegisterOption) error {
+	return r.RegisterContext(context.Background(), serviceName, instanceID, serviceHost, servicePort, serviceTags, opts...)
+}
+
+// RegisterContext is like Register but the request to consul is bound to ctx.
+func (r *Registry) RegisterContext(ctx context.Context, serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string, opts ...RegisterOption) error {
+	opt, err := newRegisterOptions(opts...)
+	if err != nil {
+		return err
+	}
+	return r.registerWithOptions(ctx, opt, serviceName, instanceID, serviceHost, servicePort, serviceTags)
+}
+
+func (r *Registry) registerWithOptions(ctx context.Context, opt registerOptions, serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string) error {
+	if opt.address != "" {
+		serviceHost = opt.address
+	}
+	cfg := ServiceConfig{Name: serviceName, Host: serviceHost, Port: servicePort, Tags: serviceTags}
+	if err := cfg.Validate(); err != nil {
 		return err
 	}
+	if opt.failOnExisting {
+		existing, err := r.GetRegistration(ctx, instanceID)
+		switch {
+		case errors.Is(err, ErrInstanceNotFound):
+		case err != nil:
+			return err
+		case existing.Address != serviceHost || existing.Port != servicePort:
+			return fmt.Errorf("%w: %s at %s", ErrInstanceExists, instanceID, joinHostPort(existing.Address, existing.Port))
+		}
+	}
+	for _, check := range opt.checks {
+		if check.HTTP != "" {
+			check.TLSSkipVerify = opt.tlsSkipVerify
+		}
+		// consul applies the thresholds only to the checks it runs itself
+		if check.TTL == "" {
+			check.SuccessBeforePassing = opt.successBeforePassing
+			check.FailuresBeforeCritical = opt.failuresBeforeCritical
+		}
+	}
+	return r.register(ctx, &api.AgentServiceRegistration{
+		Address: serviceHost,
+		ID:      instanceID,
+		Name:    serviceName,
+		Port:    servicePort,
+		Tags:    serviceTags,
+		Checks: append(
+			api.AgentServiceChecks{{
+				CheckID: instanceID,
+				TTL:     opt.checkTTL().String(),
+				Notes:   opt.notes,
+			}},
+			opt.checks...,
+		),
+	}, opt.token)
+}
+
+// RegisterNew is like Register but generates the instance ID with StableInstanceID and returns it.
+// The ID is derived from the registered address, i.e. the one of WithInterface when given.
+func (r *Registry) RegisterNew(serviceName, serviceHost string, servicePort int, serviceTags []string, opts ...RegisterOption) (string, error) {
+	opt, err := newRegisterOptions(opts...)
+	if err != nil {
+		return "", err
+	}
+	host := serviceHost
+	if opt.address != "" {
+		host = opt.address
+	}
+	instanceID := StableInstanceID(serviceName, host, servicePort)
+	if err := r.registerWithOptions(context.Background(), opt, serviceName, instanceID, serviceHost, servicePort, serviceTags); err != nil {
+		return "", err
+	}
+	return instanceID, nil
+}
+
+// StableInstanceID derives the instance identifier from the service name, host and port,
+// prefixed by the service name, so a restarted instance reuses its registration.
+func StableInstanceID(serviceName, host string, port int) string {
+	hash := uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%s|%s|%d", serviceName, host, port)))
+	return serviceName + "-" + hash.String()
+}
+
+// trackedRegistration is a registration made through the registry
+// with the token it was made with, empty for the token of the config
+type trackedRegistration struct {
+	reg   *api.AgentServiceRegistration
+	token string
+}
+
+// register sends the registration to the agent and remembers it for re-registering
+func (r *Registry) register(ctx context.Context, reg *api.AgentServiceRegistration, token string) error {
+	if err := r.client.Load().Agent().ServiceRegisterOpts(reg, api.ServiceRegisterOpts{Token: token}.WithContext(ctx)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.registrations[reg.ID] = trackedRegistration{reg: reg, token: token}
+	r.mu.Unlock()
 	return nil
 }
 
+// GetRegistration returns the instance as the local agent knows it,
+// ErrInstanceNotFound when the agent doesn't know it, e.g. after losing its state on restart.
+func (r *Registry) GetRegistration(ctx context.Context, instanceID string) (*api.AgentService, error) {
+	service, _, err := r.client.Load().Agent().Service(instanceID, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		var statusErr api.StatusError
+		if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
+		}
+		return nil, err
+	}
+	return service, nil
+}
+
+// Reregister sends again the registration of the instance made through this registry.
+func (r *Registry) Reregister(ctx context.Context, instanceID string) error {
+	tracked, err := r.registration(instanceID)
+	if err != nil {
+		return err
+	}
+	return r.register(ctx, tracked.reg, tracked.token)
+}
+
+func (r *Registry) registration(instanceID string) (trackedRegistration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tracked, ok := r.registrations[instanceID]
+	if !ok {
+		return trackedRegistration{}, fmt.Errorf("instance %s not registered through this registry", instanceID)
+	}
+	return tracked, nil
+}
+
+// UpdateTags replaces the tags of the running instance keeping the rest of its registration,
+// e.g. to move it in and out of a canary cohort. The instance must be registered through this registry,
+// otherwise its checks can't be preserved. ErrInstanceNotFound is returned when the agent doesn't know the instance.
+func (r *Registry) UpdateTags(_, instanceID string, tags []string) error {
+	current, err := r.GetRegistration(context.Background(), instanceID)
+	if err != nil {
+		return err
+	}
+	tracked, err := r.registration(instanceID)
+	if err != nil {
+		return err
+	}
+	reg := *tracked.reg
+	reg.Address = current.Address
+	reg.Port = current.Port
+	reg.Meta = current.Meta
+	reg.Tags = tags
+	return r.register(context.Background(), &reg, tracked.token)
+}
+
 // Deregister removes a service record from the registry.
-func (r *Registry) Deregister(_, instanceID string) error {
-	return r.client.Agent().ServiceDeregister(instanceID)
+func (r *Registry) Deregister(serviceName, instanceID string) error {
+	return r.DeregisterContext(context.Background(), serviceName, instanceID)
+}
+
+// DeregisterContext is like Deregister but the request to consul is bound to ctx.
+func (r *Registry) DeregisterContext(ctx context.Context, _, instanceID string) error {
+	return r.DeregisterWithToken(ctx, instanceID, "")
+}
+
+// DeregisterWithToken is like DeregisterContext but the request is made with the given ACL token
+// instead of the one of the config, e.g. an operator token removing another instance.
+// An empty token means the token of the config.
+func (r *Registry) DeregisterWithToken(ctx context.Context, instanceID, token string) error {
+	if err := r.client.Load().Agent().ServiceDeregisterOpts(instanceID, (&api.QueryOptions{Token: token}).WithContext(ctx)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.registrations, instanceID)
+	r.mu.Unlock()
+	return nil
+}
+
+// DeregisterByTag removes all instances of the service carrying the tag, e.g. "blue" during
+// a blue/green cutover. Like Deregister it is agent-local: only the instances registered on
+// the local agent are considered. Failures don't stop the others, their errors are joined.
+func (r *Registry) DeregisterByTag(serviceName, tag string) error {
+	services, err := r.client.Load().Agent().Services()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range services {
+		if s.Service != serviceName || !slices.Contains(s.Tags, tag) {
+			continue
+		}
+		if err := r.Deregister(serviceName, s.ID); err != nil {
+			errs = append(errs, fmt.Errorf("deregister %s: %w", s.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ServiceEntries returns the raw health entries of the instances of the given service
+// with their node, checks, meta and weights. It leaks the Consul API type intentionally,
+// for advanced scenarios not covered by the more specific helpers.
+func (r *Registry) ServiceEntries(serviceName string, passingOnly bool) ([]*api.ServiceEntry, error) {
+	return r.lookupEntries(serviceName, LookupOptions{PassingOnly: passingOnly})
 }
 
 // ServiceAddresses returns the list of addresses of active instances of the given service.
+// With ConsulConfig.MaxStaleness set, the cached addresses are returned when consul is unreachable.
 func (r *Registry) ServiceAddresses(serviceName string) ([]string, error) {
-	entries, _, err := r.client.Health().Service(serviceName, "", true, nil)
+	addrs, _, err := r.ServiceAddressesCached(serviceName)
+	return addrs, err
+}
+
+// ServiceAddressesCached is like ServiceAddresses but also reports whether the addresses
+// are served from the cache because consul is unreachable or reads are rate limited.
+// With DNSFallback the DNS interface is asked before the cache, except for rate limited reads
+// which would otherwise move the load from the HTTP API to the DNS interface of the same agent.
+func (r *Registry) ServiceAddressesCached(serviceName string) (addrs []string, stale bool, err error) {
+	instances, err := r.Lookup(serviceName, LookupOptions{PassingOnly: true})
+	if errors.Is(err, ErrRegistryClosed) {
+		return nil, false, err
+	}
+	if err != nil {
+		if r.dnsFallback && r.dns != nil && !errors.Is(err, ErrRateLimited) {
+			if addrs, dnsErr := r.ServiceAddressesDNS(serviceName); dnsErr == nil {
+				return addrs, false, nil
+			}
+		}
+		if r.cache != nil {
+			if addrs, ok := r.cache.load(serviceName); ok {
+				return addrs, true, nil
+			}
+		}
+		return nil, false, err
+	}
+	if len(instances) == 0 {
+		return nil, false, ErrServicesNotFound
+	}
+	for _, i := range instances {
+		addrs = append(addrs, i.HostPort())
+	}
+	if r.cache != nil {
+		r.cache.store(serviceName, addrs)
+	}
+	return addrs, false, nil
+}
+
+// ServiceAddressesFormat is like ServiceAddresses but each address is produced by format,
+// e.g. to get "http://host:port". The host is passed as is, IPv6 hosts are not bracketed.
+func (r *Registry) ServiceAddressesFormat(serviceName string, format func(host string, port int) string) ([]string, error) {
+	instances, err := r.Lookup(serviceName, LookupOptions{PassingOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, ErrServicesNotFound
+	}
+	res := make([]string, 0, len(instances))
+	for _, i := range instances {
+		res = append(res, format(i.Address, i.Port))
+	}
+	return res, nil
+}
+
+// ServiceAddressesSorted is like ServiceAddresses but the addresses are sorted,
+// so the order is the same between calls, e.g. for consistent hashing.
+func (r *Registry) ServiceAddressesSorted(serviceName string) ([]string, error) {
+	addrs, err := r.ServiceAddresses(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(addrs)
+	return addrs, nil
+}
+
+// ServiceAddressesPreferTag is like ServiceAddresses but returns the tagged address
+// of an instance (e.g. "wan") when it is registered, falling back to the primary one.
+func (r *Registry) ServiceAddressesPreferTag(serviceName, addrTag string) ([]string, error) {
+	entries, err := r.ServiceEntries(serviceName, true)
 	if err != nil {
 		return nil, err
-	} else if len(entries) == 0 {
+	}
+	if len(entries) == 0 {
+		return nil, ErrServicesNotFound
+	}
+	res := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if tagged, ok := e.Service.TaggedAddresses[addrTag]; ok && tagged.Address != "" {
+			res = append(res, joinHostPort(tagged.Address, tagged.Port))
+			continue
+		}
+		res = append(res, entryAddress(e))
+	}
+	return res, nil
+}
+
+// ServiceAddressesWithStatus returns the list of addresses of instances of the given service
+// which aren't critical. Instances in the warning state are included only if includeWarning is set.
+func (r *Registry) ServiceAddressesWithStatus(serviceName string, includeWarning bool) ([]string, error) {
+	entries, limit, err := r.queryEntries(serviceName, LookupOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*api.ServiceEntry
+	for _, e := range entries {
+		switch e.Checks.AggregatedStatus() {
+		case api.HealthPassing:
+			filtered = append(filtered, e)
+		case api.HealthWarning:
+			if includeWarning {
+				filtered = append(filtered, e)
+			}
+		}
+	}
+	return entriesAddresses(truncate(filtered, limit))
+}
+
+// ServiceAddressesHealthyNodes is like ServiceAddresses but also skips instances
+// on nodes with a node-level check (serf health and others) that isn't passing.
+func (r *Registry) ServiceAddressesHealthyNodes(serviceName string) ([]string, error) {
+	entries, limit, err := r.queryEntries(serviceName, LookupOptions{PassingOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*api.ServiceEntry
+	for _, e := range entries {
+		if nodeHealthy(e) {
+			filtered = append(filtered, e)
+		}
+	}
+	return entriesAddresses(truncate(filtered, limit))
+}
+
+// nodeHealthy reports whether all node-level checks of the entry are passing
+func nodeHealthy(e *api.ServiceEntry) bool {
+	for _, check := range e.Checks {
+		if check.ServiceID == "" && check.Status != api.HealthPassing {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceAddressesAllDC returns addresses of active instances of the given service grouped by datacenter.
+// Failures of single datacenters don't abort the call, the partial result is returned
+// together with the joined errors. Datacenters without instances are omitted.
+func (r *Registry) ServiceAddressesAllDC(serviceName string) (map[string][]string, error) {
+	dcs, err := r.client.Load().Catalog().Datacenters()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]string, len(dcs))
+	var errs []error
+	for _, dc := range dcs {
+		entries, _, err := r.client.Load().Health().Service(serviceName, "", true, &api.QueryOptions{Datacenter: dc})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("datacenter %s: %w", dc, err))
+			continue
+		}
+		if addrs, err := entriesAddresses(entries); err == nil {
+			res[dc] = addrs
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// LocalServiceAddress returns the address of the instance of the given service registered
+// on the local agent, for talking to a co-located daemon without balancing across the fleet.
+// When several local instances exist, the one with the smallest ID is returned.
+func (r *Registry) LocalServiceAddress(serviceName string) (string, error) {
+	services, err := r.client.Load().Agent().Services()
+	if err != nil {
+		return "", err
+	}
+	var local *api.AgentService
+	for _, s := range services {
+		if s.Service == serviceName && (local == nil || s.ID < local.ID) {
+			local = s
+		}
+	}
+	if local == nil {
+		return "", ErrServicesNotFound
+	}
+	address := local.Address
+	if address == "" {
+		// registered without its own address, consul uses the address of the agent's node
+		self, err := r.client.Load().Agent().Self()
+		if err != nil {
+			return "", err
+		}
+		address, _ = self["Member"]["Addr"].(string)
+	}
+	return joinHostPort(address, local.Port), nil
+}
+
+func entriesAddresses(entries []*api.ServiceEntry) ([]string, error) {
+	if len(entries) == 0 {
 		return nil, ErrServicesNotFound
 	}
 	var res []string
 	for _, e := range entries {
-		res = append(res, fmt.Sprintf("%s:%d", e.Service.Address, e.Service.Port))
+		res = append(res, entryAddress(e))
 	}
 	return res, nil
 }
 
+// entryAddress returns host:port of the instance, the address of the node is used
+// when the service is registered without its own address.
+func entryAddress(e *api.ServiceEntry) string {
+	return joinHostPort(entryHost(e), e.Service.Port)
+}
+
+func entryHost(e *api.ServiceEntry) string {
+	if e.Service.Address == "" {
+		return e.Node.Address
+	}
+	return e.Service.Address
+}
+
+// joinHostPort brackets IPv6 hosts, e.g. [fe80::1]:50051
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // ReportHealthyState is a push mechanism for reporting healthy state to the registry.
-func (r *Registry) ReportHealthyState(_, instanceID string, outputComment ...string) error {
-	return r.client.Agent().UpdateTTL(instanceID, strings.Join(outputComment, "|"), api.HealthPassing)
+// Comments are joined with "|" and shown as the check output in the Consul UI,
+// an output longer than CHECK_OUTPUT_MAX_SIZE is truncated.
+func (r *Registry) ReportHealthyState(serviceName, instanceID string, outputComment ...string) error {
+	return r.ReportHealthyStateContext(context.Background(), serviceName, instanceID, outputComment...)
+}
+
+// ReportErrors maps instanceID to the error of its health report
+type ReportErrors map[string]error
+
+func (e ReportErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", id, e[id]))
+	}
+	return "report healthy state: " + strings.Join(msgs, "; ")
+}
+
+func (e ReportErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
+// ReportHealthyStateAll reports healthy state of several instances concurrently.
+// Failures don't stop the others, they are returned as ReportErrors.
+func (r *Registry) ReportHealthyStateAll(instanceIDs []string, outputComment ...string) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = ReportErrors{}
+	)
+	for _, id := range instanceIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := r.ReportHealthyState("", id, outputComment...); err != nil {
+				mu.Lock()
+				errs[id] = err
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ReportHealthyCheck reports healthy state of the additional TTL check registered with WithTTLCheck.
+func (r *Registry) ReportHealthyCheck(checkID string, outputComment ...string) error {
+	return r.ReportHealthyStateContext(context.Background(), "", checkID, outputComment...)
+}
+
+// ReportHealthyStateContext is like ReportHealthyState but the request to consul is bound to ctx.
+func (r *Registry) ReportHealthyStateContext(ctx context.Context, _, instanceID string, outputComment ...string) error {
+	return r.ReportStateContext(ctx, instanceID, api.HealthPassing, outputComment...)
+}
+
+// ReportStateContext reports the state of the check (api.HealthPassing, api.HealthWarning
+// or api.HealthCritical) with the output, e.g. critical when a dependency of the instance is down.
+func (r *Registry) ReportStateContext(ctx context.Context, checkID, status string, outputComment ...string) error {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	return r.client.Load().Agent().UpdateTTLOpts(checkID, checkOutput(outputComment...), status, q)
+}
+
+// MakeRegistryAndRegisterService creates a registry and registers the service in it.
+// Every step is aborted as soon as ctx is done.
 func MakeRegistryAndRegisterService(ctx context.Context, instanceID string, cfgService *ServiceConfig, cfgConsul *ConsulConfig) (*Registry, error) {
 	if cfgConsul == nil {
 		cfgConsul = DefaultConfig()
 	}
+	if err := cfgService.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	registry, err := NewRegistry(cfgConsul)
 	if err != nil {
 		return nil, err
 	}
-	if cfgService == nil {
-		return nil, fmt.Errorf("service configuration not defined")
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Join(err, registry.Close())
 	}
-	if err := registry.Register(cfgService.Name, instanceID, cfgService.Host, cfgService.Port, cfgService.Tags); err != nil {
-		return nil, err
+	if err := registry.RegisterContext(ctx, cfgService.Name, instanceID, cfgService.Host, cfgService.Port, cfgService.Tags); err != nil {
+		return nil, errors.Join(err, registry.Close())
 	}
 
 	return registry, nil
@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectBuildsNewClient(t *testing.T) {
+	agent := newFakeAgent(t)
+	reg := agent.registry(t)
+	old := reg.client.Load()
+
+	if err := reg.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if reg.client.Load() == old {
+		t.Error("the client is not replaced")
+	}
+	if reg.transport == reg.config.Transport {
+		t.Error("the new client reuses the connection pool of the old one")
+	}
+}
+
+func TestReconnectKeepsClientUntilPing(t *testing.T) {
+	agent := newFakeAgent(t)
+	reg := agent.registry(t)
+	old := reg.client.Load()
+	agent.Close()
+
+	if err := reg.Reconnect(context.Background()); err == nil {
+		t.Fatal("reconnect to a stopped agent succeeded")
+	}
+	if reg.client.Load() != old {
+		t.Error("the client is replaced by one which failed Ping")
+	}
+}
+
+func TestCloseStopsWatchesAndCalls(t *testing.T) {
+	agent := newFakeAgent(t, "127.0.0.1:9000")
+	reg := agent.registry(t)
+	updates, err := reg.WatchService(context.Background(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+	// the watch is parked in a blocking query now
+
+	if err := reg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-updates:
+		case <-timeout:
+			t.Fatal("watch is not stopped by Close")
+		}
+	}
+	if _, err := reg.ServiceAddresses("svc"); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("ServiceAddresses error = %v, want %v", err, ErrRegistryClosed)
+	}
+	if _, _, err := reg.ServiceAddressesCached("svc"); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("ServiceAddressesCached error = %v, want %v", err, ErrRegistryClosed)
+	}
+	if _, err := reg.WatchService(context.Background(), "svc"); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("WatchService error = %v, want %v", err, ErrRegistryClosed)
+	}
+	if err := reg.Reconnect(context.Background()); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("Reconnect error = %v, want %v", err, ErrRegistryClosed)
+	}
+}
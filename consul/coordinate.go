@@ -0,0 +1,48 @@
+package consul
+
+import "time"
+
+// ServiceInstanceLatencies returns the round trip times between the local agent and the nodes
+// of the passing instances of the service by instanceID, estimated from the network coordinates
+// consul keeps, e.g. for latency-aware client-side balancing.
+// Instances whose node has no coordinate yet are omitted, all of them when the agent has none.
+func (r *Registry) ServiceInstanceLatencies(serviceName string) (map[string]time.Duration, error) {
+	instances, limit, err := r.lookupInstances(serviceName, LookupOptions{PassingOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, ErrServicesNotFound
+	}
+	client := r.client.Load()
+	local, err := client.Agent().NodeName()
+	if err != nil {
+		return nil, err
+	}
+	localEntries, _, err := client.Coordinate().Node(local, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Duration, len(instances))
+	if len(localEntries) == 0 || localEntries[0].Coord == nil {
+		return res, nil
+	}
+	origin := localEntries[0]
+	entries, _, err := client.Coordinate().Nodes(nil)
+	if err != nil {
+		return nil, err
+	}
+	// nodes can have a coordinate per network segment, only the one of the agent is comparable
+	rtt := make(map[string]time.Duration, len(entries))
+	for _, e := range entries {
+		if e.Segment == origin.Segment && e.Coord != nil && origin.Coord.IsCompatibleWith(e.Coord) {
+			rtt[e.Node] = origin.Coord.DistanceTo(e.Coord)
+		}
+	}
+	for _, i := range instances {
+		if d, ok := rtt[i.Node]; ok && (limit <= 0 || len(res) < limit) {
+			res[i.ID] = d
+		}
+	}
+	return res, nil
+}
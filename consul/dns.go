@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrDNSNotConfigured error = fmt.Errorf("consul dns address not configured")
+
+const (
+	default_dns_domain  = "consul"
+	default_dns_timeout = 5 * time.Second
+)
+
+// newDNSResolver makes a resolver sending all queries to the consul DNS interface at address
+func newDNSResolver(address string) *net.Resolver {
+	dialer := net.Dialer{Timeout: default_dns_timeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// ServiceAddressesDNS returns the addresses of instances of the service resolved with
+// SRV queries to the consul DNS interface (ConsulConfig.DNSAddress), for environments where
+// the HTTP API is unavailable. Returns ErrDNSNotConfigured when DNSAddress isn't set.
+// Unlike ServiceAddresses, consul DNS answers with all instances which aren't critical,
+// including the ones in the warning state, unless dns_config.only_passing is set on the agent.
+func (r *Registry) ServiceAddressesDNS(serviceName string) ([]string, error) {
+	return r.ServiceAddressesDNSContext(context.Background(), serviceName)
+}
+
+// ServiceAddressesDNSContext is like ServiceAddressesDNS but the queries are bound to ctx.
+func (r *Registry) ServiceAddressesDNSContext(ctx context.Context, serviceName string) ([]string, error) {
+	if r.isClosed() {
+		return nil, ErrRegistryClosed
+	}
+	if r.dns == nil {
+		return nil, ErrDNSNotConfigured
+	}
+	_, records, err := r.dns.LookupSRV(ctx, "", "", fmt.Sprintf("%s.service.%s.", serviceName, r.dnsDomain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, ErrServicesNotFound
+		}
+		return nil, err
+	}
+	res := make([]string, 0, len(records))
+	for _, srv := range records {
+		hosts, err := r.dns.LookupHost(ctx, srv.Target)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", strings.TrimSuffix(srv.Target, "."), err)
+		}
+		res = append(res, joinHostPort(hosts[0], int(srv.Port)))
+	}
+	if len(res) == 0 {
+		return nil, ErrServicesNotFound
+	}
+	return res, nil
+}
@@ -0,0 +1,56 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedSkipsDNSFallback(t *testing.T) {
+	agent := newFakeAgent(t, "10.0.0.1:80")
+	// counts the queries sent to the DNS interface, none is answered
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := dns.ReadFrom(buf); err != nil {
+				return
+			}
+			queries.Add(1)
+		}
+	}()
+	u, _ := url.Parse(agent.URL)
+	port, _ := strconv.Atoi(u.Port())
+	reg, err := NewRegistry(&ConsulConfig{
+		Host:          u.Hostname(),
+		Port:          port,
+		ReadRateLimit: 0.001,
+		ReadBurst:     1,
+		DNSAddress:    dns.LocalAddr().String(),
+		DNSFallback:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	if _, err := reg.ServiceAddresses("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.ServiceAddresses("svc"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("error = %v, want %v", err, ErrRateLimited)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := queries.Load(); n != 0 {
+		t.Errorf("%d DNS queries made for a rate limited read, want none", n)
+	}
+}
@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// RegistryFactory makes registries sharing one consul client (and its connection pool)
+// per consul address, credentials and headers, e.g. for a process hosting many services.
+// The shared client is torn down when the last registry using it is closed.
+// Safe for concurrent use, the zero value is ready to use.
+type RegistryFactory struct {
+	mu      sync.Mutex
+	clients map[factoryKey]*sharedClient
+}
+
+type factoryKey struct {
+	address string
+	user    string
+	pass    string
+	token   string
+	headers string
+}
+
+type sharedClient struct {
+	config *api.Config
+	client *api.Client
+	refs   int
+}
+
+// NewRegistryFactory creates an empty factory.
+func NewRegistryFactory() *RegistryFactory {
+	return &RegistryFactory{}
+}
+
+// NewRegistry is like the package NewRegistry but reuses the client of a registry
+// with the same address, credentials and headers still open. Other fields of config
+// (MaxStaleness, ReadRateLimit, ...) apply to the returned registry only.
+func (f *RegistryFactory) NewRegistry(config *ConsulConfig) (*Registry, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	key := factoryKey{
+		address: config.address(),
+		user:    config.User,
+		pass:    config.Pass,
+		token:   config.Token,
+		headers: fmt.Sprint(config.headers()),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shared, ok := f.clients[key]
+	if !ok {
+		cfg := apiConfig(config)
+		client, err := newClient(cfg, config.headers())
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedClient{config: cfg, client: client}
+		if f.clients == nil {
+			f.clients = make(map[factoryKey]*sharedClient)
+		}
+		f.clients[key] = shared
+	}
+	shared.refs++
+	return newRegistry(config, shared.config, shared.client, func() { f.release(key, shared) }), nil
+}
+
+func (f *RegistryFactory) release(key factoryKey, shared *sharedClient) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shared.refs--
+	if shared.refs > 0 {
+		return
+	}
+	if f.clients[key] == shared {
+		delete(f.clients, key)
+	}
+	shared.config.Transport.CloseIdleConnections()
+}
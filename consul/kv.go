@@ -0,0 +1,16 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// KVGet returns the value of the key in the consul KV store, ok is false when the key doesn't exist.
+func (r *Registry) KVGet(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	pair, _, err := r.client.Load().KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil || pair == nil {
+		return nil, false, err
+	}
+	return pair.Value, true, nil
+}
@@ -0,0 +1,185 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-version"
+)
+
+// LookupOptions of a direct read of service instances
+type LookupOptions struct {
+	// Select instances only with this tag
+	Tag string
+	// Select instances having all these meta key-values, filtered client-side
+	Meta map[string]string
+	// Consul filter expression, e.g. `Service.Meta.version == "2"`
+	Filter string
+	// Consul datacenter to query. Default: the datacenter of the agent
+	Datacenter string
+	// Allow stale results from a non-leader server
+	AllowStale bool
+	// Return only instances which pass all health-checks
+	PassingOnly bool
+	// Sort instances by round trip time to the node, "_agent" for the agent itself
+	Near string
+	// Limit number of instances. Default: 0, no limit
+	Limit int
+}
+
+// ServiceInstance is a projection of a consul health entry
+type ServiceInstance struct {
+	ID      string
+	Name    string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	// Aggregated status of the checks of the instance and its node
+	Status string
+}
+
+// HostPort returns the address of the instance in the host:port form
+func (i ServiceInstance) HostPort() string {
+	return joinHostPort(i.Address, i.Port)
+}
+
+// Lookup returns instances of the given service selected by opts.
+func (r *Registry) Lookup(serviceName string, opts LookupOptions) ([]ServiceInstance, error) {
+	instances, limit, err := r.lookupInstances(serviceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return truncate(instances, limit), nil
+}
+
+// lookupInstances is like Lookup but returns the limit of the lookup instead of applying it,
+// for callers which filter the instances further
+func (r *Registry) lookupInstances(serviceName string, opts LookupOptions) ([]ServiceInstance, int, error) {
+	entries, limit, err := r.queryEntries(serviceName, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	instances := make([]ServiceInstance, 0, len(entries))
+	for _, e := range entries {
+		instances = append(instances, ServiceInstance{
+			ID:      e.Service.ID,
+			Name:    e.Service.Service,
+			Node:    e.Node.Node,
+			Address: entryHost(e),
+			Port:    e.Service.Port,
+			Tags:    e.Service.Tags,
+			Meta:    e.Service.Meta,
+			Status:  e.Checks.AggregatedStatus(),
+		})
+	}
+	return instances, limit, nil
+}
+
+// SetDefaultLookupOptions sets Near and Limit applied to all lookups and dials of the registry
+// (ServiceConnectGRPC, WatchService and the ones built on them) unless given per call,
+// e.g. to always prefer the nearest instances. Other fields of opts are ignored.
+func (r *Registry) SetDefaultLookupOptions(opts LookupOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookupDefaults = LookupOptions{Near: opts.Near, Limit: max(opts.Limit, 0)}
+}
+
+func (r *Registry) defaultLookupOptions() LookupOptions {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookupDefaults
+}
+
+// defaultDialOptions are the default lookup options in the form of dial options
+func (r *Registry) defaultDialOptions() []OptionFunc {
+	defaults := r.defaultLookupOptions()
+	return []OptionFunc{WithNear(defaults.Near), WithLimit(defaults.Limit)}
+}
+
+func (r *Registry) lookupEntries(serviceName string, opts LookupOptions) ([]*api.ServiceEntry, error) {
+	entries, limit, err := r.queryEntries(serviceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return truncate(entries, limit), nil
+}
+
+// queryEntries returns the entries selected by opts and the limit of the lookup, not applied yet
+// so that the limit counts only instances which pass the client-side filters of the caller
+func (r *Registry) queryEntries(serviceName string, opts LookupOptions) ([]*api.ServiceEntry, int, error) {
+	if r.limiter != nil && !r.limiter.allow() {
+		return nil, 0, ErrRateLimited
+	}
+	defaults := r.defaultLookupOptions()
+	if opts.Near == "" {
+		opts.Near = defaults.Near
+	}
+	if opts.Limit == 0 {
+		opts.Limit = defaults.Limit
+	}
+	q := &api.QueryOptions{
+		Filter:     opts.Filter,
+		Datacenter: opts.Datacenter,
+		AllowStale: opts.AllowStale,
+		Near:       opts.Near,
+	}
+	entries, _, err := r.client.Load().Health().Service(serviceName, opts.Tag, opts.PassingOnly, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(opts.Meta) != 0 {
+		filtered := entries[:0]
+		for _, e := range entries {
+			if hasMeta(e.Service.Meta, opts.Meta) {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
+	return entries, opts.Limit, nil
+}
+
+// truncate returns the first limit elements of s, all of them if limit isn't positive
+func truncate[T any](s []T, limit int) []T {
+	if limit > 0 && len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
+
+func hasMeta(meta, want map[string]string) bool {
+	for key, value := range want {
+		if v, ok := meta[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceAddressesMinVersion returns addresses of passing instances whose meta value of metaKey
+// is a semantic version at or above minSemver, e.g. for verifying a progressive rollout.
+// Instances with a missing or invalid version are excluded.
+func (r *Registry) ServiceAddressesMinVersion(serviceName, metaKey, minSemver string) ([]string, error) {
+	minVersion, err := version.NewSemver(minSemver)
+	if err != nil {
+		return nil, fmt.Errorf("min version: %w", err)
+	}
+	instances, limit, err := r.lookupInstances(serviceName, LookupOptions{PassingOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, i := range instances {
+		v, err := version.NewSemver(i.Meta[metaKey])
+		if err != nil || v.LessThan(minVersion) {
+			continue
+		}
+		res = append(res, i.HostPort())
+	}
+	if len(res) == 0 {
+		return nil, ErrServicesNotFound
+	}
+	return truncate(res, limit), nil
+}
@@ -0,0 +1,30 @@
+package consul
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestLimitAppliesAfterFilters(t *testing.T) {
+	agent := newFakeAgent(t, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	agent.status = map[string]string{"10.0.0.1:80": api.HealthCritical, "10.0.0.2:80": api.HealthWarning}
+	reg := agent.registry(t)
+	reg.SetDefaultLookupOptions(LookupOptions{Limit: 1})
+
+	addrs, err := reg.ServiceAddressesWithStatus("svc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.3:80"}; !slices.Equal(addrs, want) {
+		t.Errorf("addresses without warning = %v, want %v", addrs, want)
+	}
+	addrs, err = reg.ServiceAddressesWithStatus("svc", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.2:80"}; !slices.Equal(addrs, want) {
+		t.Errorf("addresses with warning = %v, want %v", addrs, want)
+	}
+}
@@ -0,0 +1,227 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Function for passing registration parameters
+type RegisterOption func(options *registerOptions) error
+
+type registerOptions struct {
+	notes                  string
+	address                string
+	checks                 api.AgentServiceChecks
+	successBeforePassing   int
+	failuresBeforeCritical int
+	tlsSkipVerify          bool
+	failOnExisting         bool
+	token                  string
+}
+
+func newRegisterOptions(opts ...RegisterOption) (registerOptions, error) {
+	var opt registerOptions
+	for _, option := range opts {
+		if err := option(&opt); err != nil {
+			return registerOptions{}, err
+		}
+	}
+	return opt, nil
+}
+
+// Consul's default limit of the check output (check_output_max_size of the agent)
+const CHECK_OUTPUT_MAX_SIZE = 4096
+
+const truncated_suffix = "...(truncated)"
+
+// Static human-readable notes of the registered check, shown in the Consul UI
+func WithCheckNotes(notes string) RegisterOption {
+	return func(options *registerOptions) error {
+		options.notes = notes
+		return nil
+	}
+}
+
+// Additional TTL check (e.g. a readiness one) besides the default TTL check of the instance,
+// its state is reported with ReportHealthyCheck. The ID must be unique on the agent.
+// The instance is passing only when all its checks pass.
+func WithTTLCheck(checkID string, ttl time.Duration) RegisterOption {
+	return func(options *registerOptions) error {
+		if checkID == "" {
+			return fmt.Errorf("check id is empty")
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("check ttl must be greater than zero")
+		}
+		options.checks = append(options.checks, &api.AgentServiceCheck{
+			CheckID: checkID,
+			Name:    checkID,
+			TTL:     ttl.String(),
+		})
+		return nil
+	}
+}
+
+// Additional HTTP check performed by the agent against url each interval.
+// The ID must be unique on the agent. The instance is passing only when all its checks pass.
+func WithHTTPCheck(checkID, url string, interval, timeout time.Duration) RegisterOption {
+	return func(options *registerOptions) error {
+		if checkID == "" {
+			return fmt.Errorf("check id is empty")
+		}
+		if url == "" {
+			return fmt.Errorf("check url is empty")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("check interval must be greater than zero")
+		}
+		if timeout < 0 {
+			return fmt.Errorf("check timeout cannot be less than zero")
+		}
+		check := &api.AgentServiceCheck{
+			CheckID:  checkID,
+			Name:     checkID,
+			HTTP:     url,
+			Interval: interval.String(),
+		}
+		if timeout != 0 {
+			check.Timeout = timeout.String()
+		}
+		options.checks = append(options.checks, check)
+		return nil
+	}
+}
+
+// Additional check running the command args (e.g. []string{"/usr/local/bin/check.sh"}) each interval,
+// exit code 0 is passing, 1 warning and any other critical. The agent must have
+// enable_local_script_checks (or enable_script_checks) turned on, otherwise the registration is rejected.
+// The ID of the check is assigned by the agent. The instance is passing only when all its checks pass.
+func WithScriptCheck(args []string, interval time.Duration) RegisterOption {
+	return func(options *registerOptions) error {
+		if len(args) == 0 || args[0] == "" {
+			return fmt.Errorf("check command is empty")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("check interval must be greater than zero")
+		}
+		options.checks = append(options.checks, &api.AgentServiceCheck{
+			Name:     "script " + args[0],
+			Args:     args,
+			Interval: interval.String(),
+		})
+		return nil
+	}
+}
+
+// Don't verify the TLS certificate of https checks (e.g. self-signed internal endpoints),
+// applies to all HTTP checks of the registration. Default: false, the certificate is verified
+func WithCheckTLSSkipVerify(skip bool) RegisterOption {
+	return func(options *registerOptions) error {
+		options.tlsSkipVerify = skip
+		return nil
+	}
+}
+
+// Fail with ErrInstanceExists instead of overwriting when the agent already has the instance ID
+// registered with another address or port, e.g. two processes derived the same stable ID.
+// Registering again with the same address and port is allowed. Default: false
+func WithFailOnExisting() RegisterOption {
+	return func(options *registerOptions) error {
+		options.failOnExisting = true
+		return nil
+	}
+}
+
+// ACL token of the registration request instead of the one of the config, e.g. a more privileged one.
+// It is also used when the registration is sent again (Reconnect, Reregister, UpdateTags)
+func WithRegisterToken(token string) RegisterOption {
+	return func(options *registerOptions) error {
+		options.token = token
+		return nil
+	}
+}
+
+// Number of consecutive successful runs before the checks of WithHTTPCheck and WithScriptCheck
+// turn passing. Consul ignores it for TTL checks, the default check and the ones of WithTTLCheck
+// turn passing on the first heartbeat. Default: 0, immediately
+func WithSuccessBeforePassing(n int) RegisterOption {
+	return func(options *registerOptions) error {
+		if n < 0 {
+			return fmt.Errorf("success before passing cannot be less than zero")
+		}
+		options.successBeforePassing = n
+		return nil
+	}
+}
+
+// Number of consecutive failures tolerated before a check turns critical, so a single
+// dropped heartbeat doesn't flip the instance. Consul applies it only to the checks it runs
+// (WithHTTPCheck, WithScriptCheck), for the default TTL check the TTL is extended instead
+// by n heartbeat intervals (HEARTBEAT_INTERVAL). Default: 0, immediately
+func WithFailuresBeforeCritical(n int) RegisterOption {
+	return func(options *registerOptions) error {
+		if n < 0 {
+			return fmt.Errorf("failures before critical cannot be less than zero")
+		}
+		options.failuresBeforeCritical = n
+		return nil
+	}
+}
+
+// checkTTL is the TTL of the default check of the instance
+func (o registerOptions) checkTTL() time.Duration {
+	return default_check_ttl + time.Duration(o.failuresBeforeCritical)*HEARTBEAT_INTERVAL
+}
+
+// checkOutput joins comments into a check output which fits into CHECK_OUTPUT_MAX_SIZE,
+// so the agent doesn't cut it silently.
+func checkOutput(comments ...string) string {
+	output := strings.Join(comments, "|")
+	if len(output) <= CHECK_OUTPUT_MAX_SIZE {
+		return output
+	}
+	cut := CHECK_OUTPUT_MAX_SIZE - len(truncated_suffix)
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut--
+	}
+	return output[:cut] + truncated_suffix
+}
+
+// Register the service with the address of the named network interface instead of the given host
+func WithInterface(name string) RegisterOption {
+	return func(options *registerOptions) error {
+		address, err := AddressForInterface(name)
+		if err != nil {
+			return err
+		}
+		options.address = address
+		return nil
+	}
+}
+
+// AddressForInterface returns the first non-loopback IPv4 address of the named network interface.
+func AddressForInterface(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("interface %q: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interface %q addresses: %w", name, err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+	}
+	return "", fmt.Errorf("interface %q has no non-loopback IPv4 address", name)
+}
@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckThresholds(t *testing.T) {
+	agent := newFakeAgent(t)
+	reg := agent.registry(t)
+
+	err := reg.Register("svc", "svc-1", "10.0.0.1", 80, nil,
+		WithHTTPCheck("http", "http://10.0.0.1/health", time.Second, 0),
+		WithTTLCheck("ready", 10*time.Second),
+		WithSuccessBeforePassing(2),
+		WithFailuresBeforeCritical(3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.registered) != 1 {
+		t.Fatalf("%d registrations sent, want 1", len(agent.registered))
+	}
+	checks := agent.registered[0].Checks
+	if len(checks) != 3 {
+		t.Fatalf("%d checks registered, want 3", len(checks))
+	}
+	// consul ignores the thresholds of TTL checks, the default one tolerates the failures by its TTL
+	if ttl := checks[0]; ttl.TTL != "8s" || ttl.SuccessBeforePassing != 0 || ttl.FailuresBeforeCritical != 0 {
+		t.Errorf("default check TTL %s, thresholds %d/%d, want 8s without thresholds",
+			ttl.TTL, ttl.SuccessBeforePassing, ttl.FailuresBeforeCritical)
+	}
+	if http := checks[1]; http.SuccessBeforePassing != 2 || http.FailuresBeforeCritical != 3 {
+		t.Errorf("http check thresholds %d/%d, want 2/3", http.SuccessBeforePassing, http.FailuresBeforeCritical)
+	}
+	if ready := checks[2]; ready.TTL != "10s" || ready.SuccessBeforePassing != 0 || ready.FailuresBeforeCritical != 0 {
+		t.Errorf("additional TTL check %s, thresholds %d/%d, want 10s without thresholds",
+			ready.TTL, ready.SuccessBeforePassing, ready.FailuresBeforeCritical)
+	}
+
+	if err := reg.Register("svc", "svc-2", "10.0.0.2", 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := agent.registered[1].Checks[0].TTL; ttl != "5s" {
+		t.Errorf("default check TTL %s, want 5s", ttl)
+	}
+}
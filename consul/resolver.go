@@ -1,20 +1,51 @@
 package consul
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
-	_ "github.com/mbobakov/grpc-consul-resolver" // It's important
-
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 // Function for passing connection parameters
 type OptionFunc func(option *options) error
 
+// Reasons of OptionError
+var (
+	ErrNegativeOption  = errors.New("cannot be less than zero")
+	ErrEmptyOption     = errors.New("not defined")
+	ErrReservedOption  = errors.New("reserved by a typed option")
+	ErrMalformedOption = errors.New("malformed")
+)
+
+// OptionError is returned by an option with an invalid value.
+// It unwraps to the reason, one of ErrNegativeOption, ErrEmptyOption, ErrReservedOption or ErrMalformedOption.
+type OptionError struct {
+	// Name of the option, e.g. "limit"
+	Option string
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("option %s: %v", e.Option, e.Err)
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
+
 type options struct {
 	limit             *int
 	tag               *string
@@ -24,44 +55,196 @@ type options struct {
 	near              *string
 	timeout           *string
 	maxbackoff        *string
+	refresh           *string
+	params            url.Values
 	token             *string
 	dc                *string
 	allowstale        *bool
 	requireconsistent *bool
+	// not a part of the target, applied to the gRPC connection
+	serviceconfig        map[string]any
+	retrypolicy          *RetryPolicy
+	transportcredentials credentials.TransportCredentials
+	loadbalancing        string
+	callopts             []grpc.CallOption
+	// called by the resolver with the addresses it pushes to gRPC
+	onUpdate func(addrs []string)
 }
 
 // consul://[user:password@]127.0.0.127:8555/my-service?[healthy=]&[wait=]&[near=]&[insecure=]&[limit=]&[tag=]&[token=]
+// Two connections are involved: the resolver queries Consul (WithInsecure, WithTimeout, WithToken...)
+// and gRPC connects to the resolved instances (WithTransportCredentials, plaintext by default).
 // After a positive answer, it is advisable defer conn.Close()
 func (r *Registry) ServiceConnectGRPC(serviceName string, opts ...OptionFunc) (*grpc.ClientConn, error) {
+	if r.isClosed() {
+		return nil, ErrRegistryClosed
+	}
+	var userpass *url.Userinfo
+	if auth := r.config.HttpAuth; auth != nil && auth.Username != "" && auth.Password != "" {
+		userpass = url.UserPassword(auth.Username, auth.Password)
+	}
+	return connectGRPC(r.config.Address, userpass, r.config.Token, r.headers, serviceName, r.defaultDialOptions(), opts...)
+}
+
+// ServiceConnectGRPCUsing is like ServiceConnectGRPC but resolves the service in the consul
+// of cfg instead of the one of a registry, e.g. for calls to another cluster.
+func ServiceConnectGRPCUsing(cfg *ConsulConfig, serviceName string, opts ...OptionFunc) (*grpc.ClientConn, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
 	var userpass *url.Userinfo
-	if r.config.HttpAuth.Username != "" && r.config.HttpAuth.Password != "" {
-		userpass = url.UserPassword(r.config.HttpAuth.Username, r.config.HttpAuth.Password)
+	if cfg.User != "" && cfg.Pass != "" {
+		userpass = url.UserPassword(cfg.User, cfg.Pass)
 	}
-	querys, err := targetQueryValues(opts...)
+	return connectGRPC(cfg.address(), userpass, cfg.Token, cfg.headers(), serviceName, nil, opts...)
+}
+
+var serviceDefaults = struct {
+	sync.RWMutex
+	opts map[string][]OptionFunc
+}{opts: make(map[string][]OptionFunc)}
+
+// RegisterServiceDefaults sets options applied to every dial of the service before the options
+// of the call, so the per-call ones win. Calling it again for the service replaces its defaults.
+func RegisterServiceDefaults(serviceName string, opts ...OptionFunc) {
+	serviceDefaults.Lock()
+	defer serviceDefaults.Unlock()
+	serviceDefaults.opts[serviceName] = opts
+}
+
+func defaultOptions(serviceName string) []OptionFunc {
+	serviceDefaults.RLock()
+	defer serviceDefaults.RUnlock()
+	return serviceDefaults.opts[serviceName]
+}
+
+// connectGRPC builds the consul target. The credentials, the token (unless set by WithToken)
+// and the headers are handed to the resolver of the connection instead of the target,
+// so they don't show up in conn.Target(), logs and channelz.
+// Options apply in order: registry defaults, service defaults, options of the call.
+func connectGRPC(address string, userpass *url.Userinfo, token string, headers http.Header, serviceName string, registryDefaults []OptionFunc, opts ...OptionFunc) (*grpc.ClientConn, error) {
+	defaults := append(slices.Clip(registryDefaults), defaultOptions(serviceName)...)
+	opt, err := newOptions(append(defaults, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("decode options: %w", err)
 	}
+	serviceConfig, err := opt.serviceConfig()
+	if err != nil {
+		return nil, fmt.Errorf("service config: %w", err)
+	}
 	u := url.URL{
 		Scheme:   SELF_NAME,
-		Host:     r.config.Address,
+		Host:     address,
 		Path:     serviceName,
-		User:     userpass,
-		RawQuery: querys.Encode(),
+		RawQuery: opt.queryValues().Encode(),
+	}
+	creds := opt.transportcredentials
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	// a resolver of the connection, the globally registered one can't carry them
+	resolverBuilder := &builder{
+		user:     userpass,
+		token:    token,
+		headers:  headers,
+		onUpdate: opt.onUpdate,
 	}
 	return grpc.NewClient(
 		u.String(),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingPolicy": "%s"}`, roundrobin.Name)),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultServiceConfig(serviceConfig),
+		grpc.WithDefaultCallOptions(opt.callopts...),
+		grpc.WithResolvers(resolverBuilder),
 	)
 }
 
-func targetQueryValues(opts ...OptionFunc) (url.Values, error) {
+// DialNearest connects to the healthy instance of the service nearest to the agent by network coordinates.
+// Instances are sorted by near (the agent by default, see WithNear) and gRPC sticks to the first one with pick_first,
+// when it goes away the next nearest is picked up from the re-resolved list. pick_first overrides
+// the balancing set by WithServiceConfig. Before dialing the instances are looked up once bound to ctx,
+// ErrServicesNotFound is returned when there is no healthy one. The connection itself is established lazily.
+func (r *Registry) DialNearest(ctx context.Context, serviceName string, opts ...OptionFunc) (*grpc.ClientConn, error) {
+	opts = append([]OptionFunc{WithHealthy(true)}, opts...)
+	opts = append(opts, withLoadBalancing(grpc.PickFirstBalancerName))
+	tgt, err := r.serviceTarget(serviceName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := newWatcher(r.client.Load().Health(), tgt).query(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrServicesNotFound
+	}
+	return r.ServiceConnectGRPC(serviceName, opts...)
+}
+
+// serviceTarget returns the consul target resolved by a connection of the registry to the service,
+// the options apply in the same order as in connectGRPC
+func (r *Registry) serviceTarget(serviceName string, opts ...OptionFunc) (target, error) {
+	all := append(r.defaultDialOptions(), defaultOptions(serviceName)...)
+	query, err := targetQueryValues(append(all, opts...)...)
+	if err != nil {
+		return target{}, fmt.Errorf("decode options: %w", err)
+	}
+	tgt, err := parseQuery(query)
+	if err != nil {
+		return target{}, err
+	}
+	tgt.service = serviceName
+	return tgt, nil
+}
+
+// DialNearestOrAny connects to the healthy instance of the service nearest to nearNode
+// ("_agent" or empty for the agent) and, when it doesn't respond, to the next ones in the order
+// of distance, so any healthy instance is used while the nearest ones are down.
+// Unlike DialNearest it blocks until the connection is READY or ctx is done.
+func (r *Registry) DialNearestOrAny(ctx context.Context, serviceName, nearNode string, opts ...OptionFunc) (*grpc.ClientConn, error) {
+	// pick_first of DialNearest tries the near-sorted addresses one by one until one connects
+	conn, err := r.DialNearest(ctx, serviceName, append([]OptionFunc{WithNear(nearNode)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := WaitForReady(ctx, conn); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	return conn, nil
+}
+
+func withLoadBalancing(policy string) OptionFunc {
+	return func(options *options) error {
+		options.loadbalancing = policy
+		return nil
+	}
+}
+
+func withUpdateHook(hook func(addrs []string)) OptionFunc {
+	return func(options *options) error {
+		options.onUpdate = hook
+		return nil
+	}
+}
+
+func newOptions(opts ...OptionFunc) (options, error) {
 	var opt options
 	for _, option := range opts {
 		if err := option(&opt); err != nil {
-			return nil, err
+			return options{}, err
 		}
 	}
+	return opt, nil
+}
+
+func targetQueryValues(opts ...OptionFunc) (url.Values, error) {
+	opt, err := newOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return opt.queryValues(), nil
+}
+
+func (opt options) queryValues() url.Values {
 	args := url.Values{}
 	if opt.tag != nil {
 		args.Set("tag", *opt.tag)
@@ -87,6 +270,9 @@ func targetQueryValues(opts ...OptionFunc) (url.Values, error) {
 	if opt.maxbackoff != nil {
 		args.Set("max-backoff", *opt.maxbackoff)
 	}
+	if opt.refresh != nil {
+		args.Set("refresh", *opt.refresh)
+	}
 	if opt.token != nil {
 		args.Set("token", *opt.token)
 	}
@@ -99,8 +285,43 @@ func targetQueryValues(opts ...OptionFunc) (url.Values, error) {
 	if opt.requireconsistent != nil {
 		args.Set("require-consistent", fmt.Sprintf("%v", *opt.requireconsistent))
 	}
-	
-	return args, nil
+	for key, values := range opt.params {
+		args[key] = values
+	}
+
+	return args
+}
+
+// serviceConfig merges the round robin balancing and the retry policy into the given service config
+func (opt options) serviceConfig() (string, error) {
+	config := map[string]any{}
+	for key, value := range opt.serviceconfig {
+		config[key] = value
+	}
+	_, hasPolicy := config["loadBalancingPolicy"]
+	_, hasConfig := config["loadBalancingConfig"]
+	switch {
+	case opt.loadbalancing != "":
+		// forced by the dial function, e.g. pick_first of DialNearest
+		delete(config, "loadBalancingConfig")
+		config["loadBalancingPolicy"] = opt.loadbalancing
+	case !hasPolicy && !hasConfig:
+		config["loadBalancingPolicy"] = roundrobin.Name
+	}
+	if opt.retrypolicy != nil {
+		config["methodConfig"] = []any{
+			map[string]any{
+				// an empty name matches all methods of all services
+				"name":        []any{map[string]any{}},
+				"retryPolicy": opt.retrypolicy.serviceConfig(),
+			},
+		}
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 // Select endpoints only with this tag
@@ -127,7 +348,7 @@ func WithHealthy(healthy bool) OptionFunc {
 func WithWait(wait time.Duration) OptionFunc {
 	return func(options *options) error {
 		if wait < 0 {
-			return fmt.Errorf("wait time cannot be less than zero")
+			return &OptionError{Option: "wait", Err: ErrNegativeOption}
 		}
 		if wait != 0 {
 			duration := wait.String()
@@ -137,12 +358,52 @@ func WithWait(wait time.Duration) OptionFunc {
 	}
 }
 
-// Allow insecure communication with Consul. Default: true
+// Skip verification of the TLS certificate of Consul when the resolver queries it over https.
+// It concerns only the connection to Consul, the gRPC connection to the service
+// is secured by WithTransportCredentials. Default: false
 func WithInsecure(insecure bool) OptionFunc {
 	return func(options *options) error {
-		allow := "false"
-		if !insecure {
-			options.insecure = &allow
+		if insecure {
+			skip := "true"
+			options.insecure = &skip
+		}
+		return nil
+	}
+}
+
+// Credentials of the gRPC connection to the service, e.g. credentials.NewTLS(cfg).
+// It doesn't concern the connection to Consul, see WithInsecure. Default: insecure.NewCredentials(), plaintext
+func WithTransportCredentials(creds credentials.TransportCredentials) OptionFunc {
+	return func(options *options) error {
+		if creds == nil {
+			return &OptionError{Option: "transport credentials", Err: ErrEmptyOption}
+		}
+		options.transportcredentials = creds
+		return nil
+	}
+}
+
+// Max size in bytes of a message the connection can receive. Default: 4MB, the one of gRPC
+func WithMaxRecvMsgSize(size int) OptionFunc {
+	return func(options *options) error {
+		if size < 0 {
+			return &OptionError{Option: "max recv msg size", Err: ErrNegativeOption}
+		}
+		if size != 0 {
+			options.callopts = append(options.callopts, grpc.MaxCallRecvMsgSize(size))
+		}
+		return nil
+	}
+}
+
+// Max size in bytes of a message the connection can send. Default: math.MaxInt32, the one of gRPC
+func WithMaxSendMsgSize(size int) OptionFunc {
+	return func(options *options) error {
+		if size < 0 {
+			return &OptionError{Option: "max send msg size", Err: ErrNegativeOption}
+		}
+		if size != 0 {
+			options.callopts = append(options.callopts, grpc.MaxCallSendMsgSize(size))
 		}
 		return nil
 	}
@@ -151,16 +412,16 @@ func WithInsecure(insecure bool) OptionFunc {
 const OPT_NEAR_IP = "_ip"
 
 // Sort endpoints by response duration. Can be efficient combine with limit parameter. Default: "_agent".
+// Any node name is accepted as well as "_agent" and OPT_NEAR_IP, before only OPT_NEAR_IP was honored
+// and other values were silently ignored. An empty near keeps the default.
 // Near  - Specifies a node to sort near based on distance sorting using Network Coordinates. The nearest instance to the specified node will be returned first, and subsequent nodes in the response will be sorted in ascending order of estimated round-trip times. If the node given does not exist, the nodes in the response will be shuffled. If unspecified, the response will be shuffled by default.
 // _agent - Returns results nearest the agent servicing the request.
 // _ip - Returns results nearest to the node associated with the source IP where the query was executed from. For HTTP the source IP is the remote peer's IP address or the value of the X-Forwarded-For header with the header taking precedence. For DNS the source IP is the remote peer's IP address or the value of the EDNS client IP with the EDNS client IP taking precedence.
 func WithNear(near string) OptionFunc {
 	return func(options *options) error {
-		if (near != "" && near != OPT_NEAR_IP) || near == "" {
-			return nil
+		if near != "" {
+			options.near = &near
 		}
-		opt := OPT_NEAR_IP
-		options.near = &opt
 		return nil
 	}
 }
@@ -169,7 +430,7 @@ func WithNear(near string) OptionFunc {
 func WithLimit(limit int) OptionFunc {
 	return func(options *options) error {
 		if limit < 0 {
-			return fmt.Errorf("limit cannot be less than zero")
+			return &OptionError{Option: "limit", Err: ErrNegativeOption}
 		}
 		if limit != 0 {
 			options.limit = &limit
@@ -182,7 +443,7 @@ func WithLimit(limit int) OptionFunc {
 func WithTimeout(timeout time.Duration) OptionFunc {
 	return func(options *options) error {
 		if timeout < 0 {
-			return fmt.Errorf("timeout cannot be less than zero")
+			return &OptionError{Option: "timeout", Err: ErrNegativeOption}
 		}
 		if timeout != 0 {
 			duration := timeout.String()
@@ -196,7 +457,7 @@ func WithTimeout(timeout time.Duration) OptionFunc {
 func WithMaxBackoff(maxbackoff time.Duration) OptionFunc {
 	return func(options *options) error {
 		if maxbackoff < 0 {
-			return fmt.Errorf("maxbackoff cannot be less than zero")
+			return &OptionError{Option: "max-backoff", Err: ErrNegativeOption}
 		}
 		if maxbackoff != 0 {
 			duration := maxbackoff.String()
@@ -206,7 +467,48 @@ func WithMaxBackoff(maxbackoff time.Duration) OptionFunc {
 	}
 }
 
-// Consul token
+// Keys of the target managed by the typed options
+var reservedParams = map[string]struct{}{
+	"tag": {}, "healthy": {}, "wait": {}, "insecure": {}, "near": {}, "limit": {}, "timeout": {},
+	"max-backoff": {}, "refresh": {}, "token": {}, "dc": {}, "allow-stale": {}, "require-consistent": {},
+}
+
+// Arbitrary parameter of the target. Besides the typed options the resolver passes
+// to Consul "filter" (filter expression), "ns" (namespace), "partition" and "peer",
+// other keys are ignored. Keys managed by the typed options are rejected.
+func WithQueryParam(key, value string) OptionFunc {
+	return func(options *options) error {
+		if key == "" {
+			return &OptionError{Option: "query parameter", Err: ErrEmptyOption}
+		}
+		if _, ok := reservedParams[key]; ok {
+			return &OptionError{Option: key, Err: ErrReservedOption}
+		}
+		if options.params == nil {
+			options.params = url.Values{}
+		}
+		options.params.Set(key, value)
+		return nil
+	}
+}
+
+// Force re-resolution at least once per interval, so new instances are seen within it
+// even if the blocking query to consul hangs. Default: 0, only on changes reported by consul
+func WithRefreshInterval(interval time.Duration) OptionFunc {
+	return func(options *options) error {
+		if interval < 0 {
+			return &OptionError{Option: "refresh", Err: ErrNegativeOption}
+		}
+		if interval != 0 {
+			duration := interval.String()
+			options.refresh = &duration
+		}
+		return nil
+	}
+}
+
+// Consul token of the resolver, put into the target, so it is visible in conn.Target().
+// Without it the token of the registry (or of the config) is used, passed to the resolver directly
 func WithToken(token string) OptionFunc {
 	return func(options *options) error {
 		if token != "" {
@@ -241,3 +543,69 @@ func WithRequireConsistent(require bool) OptionFunc {
 		return nil
 	}
 }
+
+// RetryPolicy of gRPC transparent retries, see https://github.com/grpc/proposal/blob/master/A6-client-retries.md
+type RetryPolicy struct {
+	// Including the original attempt, must be greater than 1
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// e.g. codes.Unavailable
+	RetryableStatusCodes []codes.Code
+}
+
+func (p *RetryPolicy) validate() error {
+	switch {
+	case p.MaxAttempts < 2:
+		return &OptionError{Option: "retry policy", Err: fmt.Errorf("%w: max attempts must be greater than 1", ErrMalformedOption)}
+	case p.InitialBackoff <= 0 || p.MaxBackoff <= 0:
+		return &OptionError{Option: "retry policy", Err: fmt.Errorf("%w: backoff must be greater than zero", ErrMalformedOption)}
+	case p.BackoffMultiplier <= 0:
+		return &OptionError{Option: "retry policy", Err: fmt.Errorf("%w: backoff multiplier must be greater than zero", ErrMalformedOption)}
+	case len(p.RetryableStatusCodes) == 0:
+		return &OptionError{Option: "retry policy", Err: fmt.Errorf("%w: retryable status codes not defined", ErrMalformedOption)}
+	}
+	return nil
+}
+
+func (p *RetryPolicy) serviceConfig() map[string]any {
+	return map[string]any{
+		"maxAttempts":          p.MaxAttempts,
+		"initialBackoff":       jsonDuration(p.InitialBackoff),
+		"maxBackoff":           jsonDuration(p.MaxBackoff),
+		"backoffMultiplier":    p.BackoffMultiplier,
+		"retryableStatusCodes": p.RetryableStatusCodes,
+	}
+}
+
+// jsonDuration formats d as the JSON representation of google.protobuf.Duration
+func jsonDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// Full gRPC service config in JSON. The round robin balancing is added unless the config sets its own
+func WithServiceConfig(serviceConfig string) OptionFunc {
+	return func(options *options) error {
+		if serviceConfig == "" {
+			return nil
+		}
+		config := map[string]any{}
+		if err := json.Unmarshal([]byte(serviceConfig), &config); err != nil {
+			return &OptionError{Option: "service config", Err: fmt.Errorf("%w: %w", ErrMalformedOption, err)}
+		}
+		options.serviceconfig = config
+		return nil
+	}
+}
+
+// Retry policy for all methods of the connection. Overrides methodConfig of WithServiceConfig
+func WithRetryPolicy(policy RetryPolicy) OptionFunc {
+	return func(options *options) error {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		options.retrypolicy = &policy
+		return nil
+	}
+}
@@ -0,0 +1,371 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+// targetOf dials lazily and returns the consul target of the connection
+func targetOf(t *testing.T, opts ...OptionFunc) target {
+	t.Helper()
+	conn, err := ServiceConnectGRPCUsing(&ConsulConfig{Host: "127.0.0.1", Port: 8500}, "svc", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	u, err := url.Parse(conn.Target())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt, err := parseTarget(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tgt
+}
+
+func TestInsecureConcernsOnlyConsul(t *testing.T) {
+	opt, err := newOptions(WithInsecure(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.transportcredentials != nil {
+		t.Error("WithInsecure changed the credentials of the gRPC connection")
+	}
+	tgt := targetOf(t, WithInsecure(true))
+	if !tgt.consulConfig().TLSConfig.InsecureSkipVerify {
+		t.Error("WithInsecure didn't disable the verification of the consul certificate")
+	}
+}
+
+func TestTransportCredentialsConcernOnlyGRPC(t *testing.T) {
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	opt, err := newOptions(WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.transportcredentials != creds {
+		t.Error("WithTransportCredentials didn't set the credentials of the gRPC connection")
+	}
+	if opt.queryValues().Has("insecure") {
+		t.Error("WithTransportCredentials leaked into the consul target")
+	}
+	tgt := targetOf(t, WithTransportCredentials(creds))
+	if tgt.consulConfig().TLSConfig.InsecureSkipVerify {
+		t.Error("WithTransportCredentials changed the verification of the consul certificate")
+	}
+}
+
+// fakeAgent serves the health endpoint of consul with the instances of one service
+// in the given order, as consul does when sorting by near. Blocking queries hang until
+// the request is done, so the resolver keeps the first answer.
+type fakeAgent struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	addrs    []string
+	requests []*http.Request
+	// check status of the instances by address, passing if not set
+	status map[string]string
+	// registrations received by the agent
+	registered []*api.AgentServiceRegistration
+}
+
+func newFakeAgent(t *testing.T, addrs ...string) *fakeAgent {
+	t.Helper()
+	a := &fakeAgent{addrs: addrs}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	t.Cleanup(a.Close)
+	return a
+}
+
+func (a *fakeAgent) serve(w http.ResponseWriter, req *http.Request) {
+	a.mu.Lock()
+	a.requests = append(a.requests, req)
+	addrs, status := a.addrs, a.status
+	a.mu.Unlock()
+	switch {
+	case req.URL.Path == "/v1/status/leader":
+		json.NewEncoder(w).Encode("127.0.0.1:8300")
+	case req.URL.Path == "/v1/agent/service/register":
+		var reg api.AgentServiceRegistration
+		if err := json.NewDecoder(req.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.mu.Lock()
+		a.registered = append(a.registered, &reg)
+		a.mu.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/health/service/"):
+		if req.URL.Query().Get("index") == "1" {
+			<-req.Context().Done()
+			return
+		}
+		entries := make([]*api.ServiceEntry, 0, len(addrs))
+		for _, addr := range addrs {
+			host, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			checkStatus := api.HealthPassing
+			if s, ok := status[addr]; ok {
+				checkStatus = s
+			}
+			if req.URL.Query().Has("passing") && checkStatus != api.HealthPassing {
+				continue
+			}
+			entries = append(entries, &api.ServiceEntry{
+				Node:    &api.Node{Node: addr},
+				Service: &api.AgentService{ID: addr, Address: host, Port: p},
+				Checks:  api.HealthChecks{{Status: checkStatus}},
+			})
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// healthRequests returns the queries of the health endpoint
+func (a *fakeAgent) healthRequests() []*http.Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var res []*http.Request
+	for _, req := range a.requests {
+		if strings.HasPrefix(req.URL.Path, "/v1/health/service/") {
+			res = append(res, req)
+		}
+	}
+	return res
+}
+
+func (a *fakeAgent) registry(t *testing.T) *Registry {
+	t.Helper()
+	u, _ := url.Parse(a.URL)
+	port, _ := strconv.Atoi(u.Port())
+	reg, err := NewRegistry(&ConsulConfig{Host: u.Hostname(), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reg.Close() })
+	return reg
+}
+
+// startBackend starts a gRPC server with the health service and returns its address
+func startBackend(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// servedBy calls the backend through conn and returns the address of the one which answered
+func servedBy(t *testing.T, conn *grpc.ClientConn) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var p peer.Peer
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p), grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	return p.Addr.String()
+}
+
+func TestDialNearestPicksFirst(t *testing.T) {
+	nearest, farther := startBackend(t), startBackend(t)
+	agent := newFakeAgent(t, nearest, farther)
+	reg := agent.registry(t)
+
+	conn, err := reg.DialNearest(context.Background(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		if got := servedBy(t, conn); got != nearest {
+			t.Fatalf("call %d served by %s, want the nearest %s", i, got, nearest)
+		}
+	}
+	for _, req := range agent.healthRequests() {
+		if req.URL.Query().Get("near") != default_near || !req.URL.Query().Has("passing") {
+			t.Errorf("instances queried without near sorting or health filter: %s", req.URL)
+		}
+	}
+}
+
+func TestDialNearestNoInstances(t *testing.T) {
+	reg := newFakeAgent(t).registry(t)
+	if _, err := reg.DialNearest(context.Background(), "svc"); !errors.Is(err, ErrServicesNotFound) {
+		t.Errorf("error = %v, want %v", err, ErrServicesNotFound)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := reg.DialNearest(ctx, "svc"); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestForcedBalancingOverridesServiceConfig(t *testing.T) {
+	opt, err := newOptions(
+		WithServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`),
+		withLoadBalancing(grpc.PickFirstBalancerName),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := opt.serviceConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]any
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config["loadBalancingConfig"]; ok || config["loadBalancingPolicy"] != grpc.PickFirstBalancerName {
+		t.Errorf("pick_first is not enforced: %s", raw)
+	}
+}
+
+func TestWithNear(t *testing.T) {
+	for _, tc := range []struct {
+		near, want string
+	}{
+		{"", default_near},
+		{OPT_NEAR_IP, OPT_NEAR_IP},
+		{"_agent", "_agent"},
+		{"node-1", "node-1"},
+	} {
+		if got := targetOf(t, WithNear(tc.near)).near; got != tc.want {
+			t.Errorf("WithNear(%q): near = %q, want %q", tc.near, got, tc.want)
+		}
+	}
+}
+
+// deadAddress returns an address nothing listens on
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestDialNearestOrAnyFallsBack(t *testing.T) {
+	nearest, reachable := deadAddress(t), startBackend(t)
+	agent := newFakeAgent(t, nearest, reachable)
+	reg := agent.registry(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := reg.DialNearestOrAny(ctx, "svc", "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := servedBy(t, conn); got != reachable {
+		t.Errorf("served by %s, want the reachable %s", got, reachable)
+	}
+	for _, req := range agent.healthRequests() {
+		if req.URL.Query().Get("near") != "node-1" {
+			t.Errorf("instances not sorted near the node: %s", req.URL)
+		}
+	}
+}
+
+func TestResolverSendsHeaders(t *testing.T) {
+	backend := startBackend(t)
+	agent := newFakeAgent(t, backend)
+	u, _ := url.Parse(agent.URL)
+	port, _ := strconv.Atoi(u.Port())
+	cfg := &ConsulConfig{
+		Host:      u.Hostname(),
+		Port:      port,
+		UserAgent: "billing",
+		Headers:   http.Header{"X-Team": {"payments"}},
+	}
+	reg, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	for name, dial := range map[string]func() (*grpc.ClientConn, error){
+		"ServiceConnectGRPC":      func() (*grpc.ClientConn, error) { return reg.ServiceConnectGRPC("svc") },
+		"ServiceConnectGRPCUsing": func() (*grpc.ClientConn, error) { return ServiceConnectGRPCUsing(cfg, "svc") },
+	} {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servedBy(t, conn)
+		conn.Close()
+		for _, req := range agent.healthRequests() {
+			if req.UserAgent() != "billing" || req.Header.Get("X-Team") != "payments" {
+				t.Errorf("%s: resolver queried consul without the headers: %v", name, req.Header)
+			}
+		}
+	}
+}
+
+func TestTargetHidesCredentials(t *testing.T) {
+	backend := startBackend(t)
+	agent := newFakeAgent(t, backend)
+	u, _ := url.Parse(agent.URL)
+	port, _ := strconv.Atoi(u.Port())
+	reg, err := NewRegistry(&ConsulConfig{Host: u.Hostname(), Port: port, User: "user", Pass: "pass", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	conn, err := reg.ServiceConnectGRPC("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := conn.Target(); strings.Contains(target, "secret") || strings.Contains(target, "pass") {
+		t.Errorf("credentials exposed in the target %s", target)
+	}
+	servedBy(t, conn)
+	for _, req := range agent.healthRequests() {
+		user, pass, _ := req.BasicAuth()
+		if req.Header.Get("X-Consul-Token") != "secret" || user != "user" || pass != "pass" {
+			t.Errorf("resolver queried consul without the credentials: %v", req.Header)
+		}
+	}
+
+	conn, err = reg.ServiceConnectGRPC("svc", WithToken("explicit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !strings.Contains(conn.Target(), "token=explicit") {
+		t.Errorf("token of WithToken missing in the target %s", conn.Target())
+	}
+}
@@ -2,101 +2,574 @@ package retryer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
+	"github.com/hashicorp/consul/api"
 	"github.com/quietpleasure/discovery"
 	"github.com/quietpleasure/discovery/consul"
 )
 
+const (
+	heartbeat_interval     = consul.HEARTBEAT_INTERVAL
+	registration_check     = 10 // every n-th heartbeat verifies the registration
+	drain_check            = 10 // every n-th heartbeat reads the drain key, starting with the first
+	deregister_max_elapsed = 5 * time.Second
+	best_effort_timeout    = time.Second
+	// a reconnect attempt to an agent accepting connections but never answering is abandoned after it
+	reconnect_attempt_timeout = 5 * time.Second
+	// delays between attempts: base, 2*base, 4*base... up to max
+	retry_base_delay = 250 * time.Millisecond
+	retry_max_delay  = 30 * time.Second
+)
+
 type FuncExecutor func(ctx context.Context, instanceID string, cfgService *consul.ServiceConfig, cfgConsul *consul.ConsulConfig) (*consul.Registry, error)
 
+// Severity of the feedback
+type Level int
+
+const (
+	// progress, e.g. a successful attempt
+	LEVEL_INFO Level = iota
+	// failure which is going to be retried
+	LEVEL_WARN
+	// failure the retries gave up on
+	LEVEL_ERROR
+)
+
+func (l Level) String() string {
+	switch l {
+	case LEVEL_INFO:
+		return "info"
+	case LEVEL_WARN:
+		return "warn"
+	case LEVEL_ERROR:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
 type Feedback struct {
+	Level   Level
 	Error   error
 	Message string
 }
 
-func retry(function FuncExecutor, feedback chan Feedback, maxAttempts ...int) FuncExecutor {
-	var max int
-	if len(maxAttempts) > 0 {
-		max = maxAttempts[0]
+// Function for passing retry parameters
+type RetryOption func(options *retryOptions)
+
+type retryOptions struct {
+	maxAttempts int
+	maxElapsed  time.Duration
+	retryable   func(err error) bool
+}
+
+func newRetryOptions(opts ...RetryOption) retryOptions {
+	options := retryOptions{retryable: IsRetryable}
+	for _, option := range opts {
+		option(&options)
 	}
-	return func(ctx context.Context, instanceID string, cfgService *consul.ServiceConfig, cfgConsul *consul.ConsulConfig) (*consul.Registry, error) {
-		attempt := 1
-		for {
-			reg, err := function(ctx, instanceID, cfgService, cfgConsul)
-			if err == nil {
-				feedback <- Feedback{
-					Message: fmt.Sprintf("retry attempt %d successful", attempt),
-				}
-				return reg, nil
-			}
-			if attempt == max && max != 0 {
-				feedback <- Feedback{
-					Message: "all attempts used",
-				}
-				return reg, err
-			}
-			delay := time.Second << uint(attempt)
-			feedback <- Feedback{
-				Error:   err,
-				Message: fmt.Sprintf("retry attempt %d failed repeat after %s", attempt, delay),
-			}
-			select {
-			case <-time.After(delay):
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			}
-			attempt++
+	return options
+}
+
+// Limit number of attempts. Default: 0, no limit
+func WithMaxAttempts(max int) RetryOption {
+	return func(options *retryOptions) {
+		if max > 0 {
+			options.maxAttempts = max
+		}
+	}
+}
+
+// Limit total time of retries. Used by DeregisterWithRetry
+func WithMaxElapsed(maxElapsed time.Duration) RetryOption {
+	return func(options *retryOptions) {
+		if maxElapsed > 0 {
+			options.maxElapsed = maxElapsed
+		}
+	}
+}
+
+// Classifier of errors worth retrying. Default: IsRetryable
+func WithRetryable(retryable func(err error) bool) RetryOption {
+	return func(options *retryOptions) {
+		if retryable != nil {
+			options.retryable = retryable
+		}
+	}
+}
+
+// Option of the heartbeat loop of CheckHealthAndReconnect: its own ones (WithMinLevel,
+// WithHealthFunc, WithDrainKey) or any RetryOption, which applies to the reconnects
+type LoopOption interface {
+	applyLoop(options *loopOptions)
+}
+
+type loopOptionFunc func(options *loopOptions)
+
+func (f loopOptionFunc) applyLoop(options *loopOptions) {
+	f(options)
+}
+
+func (f RetryOption) applyLoop(options *loopOptions) {
+	options.retry = append(options.retry, f)
+}
+
+type loopOptions struct {
+	retry      []RetryOption
+	minLevel   Level
+	health     func() (healthy bool, output string)
+	drainKey   string
+	drainGrace time.Duration
+}
+
+func newLoopOptions(opts ...LoopOption) loopOptions {
+	var options loopOptions
+	for _, option := range opts {
+		option.applyLoop(&options)
+	}
+	return options
+}
+
+// Drop feedback below the level before it is sent to the channel of CheckHealthAndReconnect.
+// Default: LEVEL_INFO, everything is sent
+func WithMinLevel(level Level) LoopOption {
+	return loopOptionFunc(func(options *loopOptions) {
+		options.minLevel = level
+	})
+}
+
+// Function called by CheckHealthAndReconnect on each heartbeat, the instance is reported
+// passing or critical with the output, so the check reflects the actual readiness of the application.
+// With a registry unable to report critical the heartbeat is skipped instead.
+// Default: always healthy without output
+func WithHealthFunc(health func() (healthy bool, output string)) LoopOption {
+	return loopOptionFunc(func(options *loopOptions) {
+		options.health = health
+	})
+}
+
+// Drain the instance when the consul KV key is set to a non-empty value, e.g. for a fleet-wide
+// maintenance: CheckHealthAndReconnect reports the instance warning during the first half
+// of the grace period, so clients move away from it, and critical during the second half,
+// so the remaining ones stop picking it, then deregisters it and stops with Summary.Drained set.
+// Clearing the key during the grace period cancels the drain. The key is read on the first
+// heartbeat and then on every 10th one to spare the consul servers, failed reads are ignored.
+// Requires a registry able to read KV, e.g. *consul.Registry
+func WithDrainKey(key string, grace time.Duration) LoopOption {
+	return loopOptionFunc(func(options *loopOptions) {
+		if key != "" && grace >= 0 {
+			options.drainKey = key
+			options.drainGrace = grace
+		}
+	})
+}
+
+// IsRetryable reports whether the attempt failed with err can succeed later.
+// Invalid configuration, cancelled context, a closed registry and consul responses
+// with 4xx status codes (bad request, ACL denied, ...) are permanent,
+// except 408 and 429. All other errors are considered transient.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, consul.ErrInvalidServiceConfig) || errors.Is(err, context.Canceled) || errors.Is(err, consul.ErrRegistryClosed) {
+		return false
+	}
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.Code == http.StatusRequestTimeout, statusErr.Code == http.StatusTooManyRequests:
+			return true
+		case statusErr.Code >= 400 && statusErr.Code < 500:
+			return false
 		}
 	}
+	return true
+}
+
+// withAttemptTimeout bounds each call of function by reconnect_attempt_timeout
+func withAttemptTimeout(function FuncExecutor) FuncExecutor {
+	return func(ctx context.Context, instanceID string, cfgService *consul.ServiceConfig, cfgConsul *consul.ConsulConfig) (*consul.Registry, error) {
+		ctx, cancel := context.WithTimeout(ctx, reconnect_attempt_timeout)
+		defer cancel()
+		return function(ctx, instanceID, cfgService, cfgConsul)
+	}
+}
+
+func retry(function FuncExecutor, feedback chan Feedback, opts ...RetryOption) FuncExecutor {
+	options := newRetryOptions(opts...)
+	return func(ctx context.Context, instanceID string, cfgService *consul.ServiceConfig, cfgConsul *consul.ConsulConfig) (*consul.Registry, error) {
+		var reg *consul.Registry
+		err := attempts(ctx, options, feedback, func(ctx context.Context) error {
+			var err error
+			reg, err = function(ctx, instanceID, cfgService, cfgConsul)
+			return err
+		})
+		return reg, err
+	}
 }
 
-func CheckHealthAndReconnect(ctx context.Context, instanceID string, reg discovery.Registry, serviceCfg *consul.ServiceConfig, logFeedback chan Feedback, maxAttempts ...int) {
-	feedback := make(chan Feedback)
-	defer close(feedback)
+// attempts calls fn until it succeeds, fails with a non-retryable error,
+// the attempts are used up or ctx is done. Feedback is skipped when the channel is nil.
+func attempts(ctx context.Context, options retryOptions, feedback chan Feedback, fn func(ctx context.Context) error) error {
+	send := func(f Feedback) {
+		if feedback != nil {
+			feedback <- f
+		}
+	}
+	attempt := 1
 	for {
+		err := fn(ctx)
+		if err == nil {
+			send(Feedback{
+				Level:   LEVEL_INFO,
+				Message: fmt.Sprintf("retry attempt %d successful", attempt),
+			})
+			return nil
+		}
+		// the attempt was aborted in flight, fn gets ctx so the request to consul is cancelled with it
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !options.retryable(err) {
+			send(Feedback{
+				Level:   LEVEL_ERROR,
+				Error:   err,
+				Message: fmt.Sprintf("retry attempt %d failed with non-retryable error", attempt),
+			})
+			return err
+		}
+		if attempt == options.maxAttempts {
+			send(Feedback{
+				Level:   LEVEL_ERROR,
+				Message: "all attempts used",
+			})
+			return err
+		}
+		delay := retryDelay(attempt)
+		send(Feedback{
+			Level:   LEVEL_WARN,
+			Error:   err,
+			Message: fmt.Sprintf("retry attempt %d failed repeat after %s", attempt, delay),
+		})
 		select {
+		case <-time.After(delay):
 		case <-ctx.Done():
-			return
-		default:
-			if err := reg.ReportHealthyState("", instanceID); err != nil {
-				//отвалился коннект к Консулу, нужно переподключать
-				// log.Printf("trying new make registry and register | ERORR: %s\n", err)
-				logFeedback <- Feedback{
-					Error:   err,
-					Message: "trying new make registry and register",
+			return ctx.Err()
+		}
+		attempt++
+	}
+}
+
+// retryDelay is the delay after the failed attempt, attempts are counted from 1
+func retryDelay(attempt int) time.Duration {
+	delay := retry_base_delay
+	for i := 1; i < attempt && delay < retry_max_delay; i++ {
+		delay *= 2
+	}
+	return min(delay, retry_max_delay)
+}
+
+// NewRegistryWithRetry creates a registry and waits until consul responds to Ping,
+// retrying with the backoff of the retryer until ctx is done or the attempts are used up.
+func NewRegistryWithRetry(ctx context.Context, cfg *consul.ConsulConfig, opts ...RetryOption) (*consul.Registry, error) {
+	reg, err := consul.NewRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := attempts(ctx, newRetryOptions(opts...), nil, reg.Ping); err != nil {
+		return nil, errors.Join(err, reg.Close())
+	}
+	return reg, nil
+}
+
+// DeregisterWithRetry removes the instance from the registry retrying transient failures
+// with the backoff of the retryer, so a busy agent doesn't leave a stale record.
+// Retries are bounded by ctx and WithMaxElapsed (default 5s), after that
+// one more best-effort attempt is made even if ctx is already done.
+func DeregisterWithRetry(ctx context.Context, reg discovery.Registry, instanceID string, opts ...RetryOption) error {
+	options := newRetryOptions(opts...)
+	maxElapsed := options.maxElapsed
+	if maxElapsed == 0 {
+		maxElapsed = deregister_max_elapsed
+	}
+	retryCtx, cancel := context.WithTimeout(ctx, maxElapsed)
+	err := attempts(retryCtx, options, nil, func(ctx context.Context) error {
+		return reg.DeregisterContext(ctx, "", instanceID)
+	})
+	cancel()
+	expired := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	if err == nil || !expired && !options.retryable(err) {
+		return err
+	}
+	lastCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), best_effort_timeout)
+	defer cancel()
+	if lastErr := reg.DeregisterContext(lastCtx, "", instanceID); lastErr != nil {
+		return errors.Join(err, lastErr)
+	}
+	return nil
+}
+
+type stateReporter interface {
+	ReportStateContext(ctx context.Context, checkID, status string, outputComment ...string) error
+}
+
+// heartbeat reports the state of the instance, passing unless health tells otherwise
+// and drainStatus while it is draining
+func heartbeat(ctx context.Context, reg discovery.Registry, instanceID string, health func() (bool, string), drainStatus string) error {
+	if drainStatus != "" {
+		if r, ok := reg.(stateReporter); ok {
+			return r.ReportStateContext(ctx, instanceID, drainStatus, "draining")
+		}
+	}
+	if health == nil {
+		return reg.ReportHealthyStateContext(ctx, "", instanceID)
+	}
+	healthy, output := health()
+	if r, ok := reg.(stateReporter); ok {
+		status := api.HealthPassing
+		if !healthy {
+			status = api.HealthCritical
+		}
+		return r.ReportStateContext(ctx, instanceID, status, output)
+	}
+	if !healthy {
+		// the TTL expires and the check turns critical by itself
+		return nil
+	}
+	return reg.ReportHealthyStateContext(ctx, "", instanceID, output)
+}
+
+type kvGetter interface {
+	KVGet(ctx context.Context, key string) (value []byte, ok bool, err error)
+}
+
+// drainStatus is the state reported for an instance draining for elapsed of grace,
+// warning for the first half and critical for the second one
+func drainStatus(elapsed, grace time.Duration) string {
+	if elapsed < grace/2 {
+		return api.HealthWarning
+	}
+	return api.HealthCritical
+}
+
+// drainRequested reports whether the drain key is set, failed reads count as not set
+func drainRequested(ctx context.Context, reg discovery.Registry, key string) bool {
+	r, ok := reg.(kvGetter)
+	if !ok {
+		return false
+	}
+	readCtx, cancel := context.WithTimeout(ctx, heartbeat_interval/2)
+	defer cancel()
+	value, ok, err := r.KVGet(readCtx, key)
+	return err == nil && ok && len(value) != 0
+}
+
+type reconnecter interface {
+	Reconnect(ctx context.Context) error
+}
+
+type reregisterer interface {
+	GetRegistration(ctx context.Context, instanceID string) (*api.AgentService, error)
+	Reregister(ctx context.Context, instanceID string) error
+}
+
+// healRegistration registers the instance again when the agent has forgotten it,
+// e.g. after a restart which wiped its state. Registries unable to tell are skipped.
+func healRegistration(ctx context.Context, reg discovery.Registry, instanceID string) (bool, error) {
+	r, ok := reg.(reregisterer)
+	if !ok {
+		return false, nil
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, heartbeat_interval/2)
+	defer cancel()
+	_, err := r.GetRegistration(checkCtx, instanceID)
+	if !errors.Is(err, consul.ErrInstanceNotFound) {
+		return false, err
+	}
+	return true, r.Reregister(checkCtx, instanceID)
+}
+
+// Summary of the heartbeat loop lifetime
+type Summary struct {
+	// Successful reconnects to consul
+	Reconnects int
+	// Error the loop stopped with, nil when it stopped because ctx is done
+	Err error
+	// Last error of a heartbeat or a reconnect attempt
+	LastError error
+	// Total time between failed heartbeats and successful reconnects
+	Downtime time.Duration
+	// The instance was deregistered on request of the drain key, see WithDrainKey
+	Drained bool
+}
+
+// CheckHealthAndReconnect starts the heartbeat loop of the instance in a separate goroutine
+// and reconnects to consul when a heartbeat fails. Feedback is sent to logFeedback, reconnect
+// attempts are buffered with the capacity of logFeedback. Once the loop has stopped and doesn't
+// touch the registry anymore, its Summary is sent to the returned channel and the channel is closed.
+// The loop stops when ctx is done, the instance is drained (WithDrainKey)
+// or reconnecting fails, then Summary.Err is set.
+// Feedback below WithMinLevel is dropped, it still counts for Summary.
+// RetryOptions among opts (e.g. WithMaxAttempts) apply to the reconnect attempts.
+func CheckHealthAndReconnect(ctx context.Context, instanceID string, reg discovery.Registry, serviceCfg *consul.ServiceConfig, logFeedback chan Feedback, opts ...LoopOption) <-chan Summary {
+	options := newLoopOptions(opts...)
+	report := func(f Feedback) {
+		if f.Level >= options.minLevel {
+			logFeedback <- f
+		}
+	}
+	done := make(chan Summary, 1)
+	go func() {
+		var (
+			summary       Summary
+			drainingSince time.Time
+		)
+		defer func() {
+			done <- summary
+			close(done)
+		}()
+		for beat := 1; ; beat++ {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if beat%registration_check == 0 {
+					if healed, err := healRegistration(ctx, reg, instanceID); healed {
+						level := LEVEL_WARN
+						if err != nil {
+							level = LEVEL_ERROR
+						}
+						report(Feedback{
+							Level:   level,
+							Error:   err,
+							Message: "instance lost by the agent, registered again",
+						})
+					}
 				}
-				var max int
-				if maxAttempts != nil {
-					max = maxAttempts[0]
+				if options.drainKey != "" && beat%drain_check == 1 {
+					switch requested := drainRequested(ctx, reg, options.drainKey); {
+					case requested && drainingSince.IsZero():
+						drainingSince = time.Now()
+						report(Feedback{
+							Level:   LEVEL_WARN,
+							Message: fmt.Sprintf("drain requested, deregister after %s", options.drainGrace),
+						})
+					case !requested && !drainingSince.IsZero():
+						drainingSince = time.Time{}
+						report(Feedback{
+							Level:   LEVEL_INFO,
+							Message: "drain cancelled",
+						})
+					}
 				}
-				retryFunc := retry(consul.MakeRegistryAndRegisterService, feedback, max)
-				var (
-					newreg *consul.Registry
-					rerr   error
-				)
-				go func() {
-					newreg, rerr = retryFunc(ctx, instanceID, serviceCfg, nil)
-				}()
-				for f := range feedback {
-					// if f.Error != nil {
-					// 	log.Printf("%s | ERROR: %s\n", f.Message, f.Error)						
-					// } else {
-					// 	log.Println(f.Message)
-					// }
-					logFeedback <- f
+				if !drainingSince.IsZero() && time.Since(drainingSince) >= options.drainGrace {
+					// clients still picking the instance (e.g. with a short grace) see it critical first
+					if r, ok := reg.(stateReporter); ok {
+						reportCtx, cancel := context.WithTimeout(ctx, best_effort_timeout)
+						r.ReportStateContext(reportCtx, instanceID, api.HealthCritical, "draining")
+						cancel()
+					}
+					if err := reg.DeregisterContext(ctx, "", instanceID); err != nil {
+						summary.LastError = err
+						summary.Err = err
+						report(Feedback{
+							Level:   LEVEL_ERROR,
+							Error:   err,
+							Message: "deregister drained instance",
+						})
+						return
+					}
+					summary.Drained = true
+					report(Feedback{
+						Level:   LEVEL_WARN,
+						Message: "instance drained and deregistered",
+					})
+					return
 				}
-				// "successful new consul connect" or all attempts used with error
-				if rerr == nil {
-					reg = newreg
-				} else {
-					//вышли все попытки подключения нет смыслы в работе сервиса
-					panic(err)
+				// a beat that doesn't fit into half of the interval is treated as failed,
+				// so a stalled agent connection can't block the loop
+				beatCtx, cancel := context.WithTimeout(ctx, heartbeat_interval/2)
+				status := ""
+				if !drainingSince.IsZero() {
+					status = drainStatus(time.Since(drainingSince), options.drainGrace)
+				}
+				err := heartbeat(beatCtx, reg, instanceID, options.health, status)
+				cancel()
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					//отвалился коннект к Консулу, нужно переподключать
+					summary.LastError = err
+					failedAt := time.Now()
+					report(Feedback{
+						Level:   LEVEL_WARN,
+						Error:   err,
+						Message: "trying new make registry and register",
+					})
+					feedback := make(chan Feedback, cap(logFeedback))
+					var (
+						newreg discovery.Registry = reg
+						rerr   error
+					)
+					go func() {
+						defer close(feedback)
+						// a registry able to reconnect in place keeps the references of the caller valid
+						if r, ok := reg.(reconnecter); ok {
+							rerr = attempts(ctx, newRetryOptions(options.retry...), feedback, func(ctx context.Context) error {
+								attemptCtx, cancel := context.WithTimeout(ctx, reconnect_attempt_timeout)
+								defer cancel()
+								return r.Reconnect(attemptCtx)
+							})
+							return
+						}
+						newreg, rerr = retry(withAttemptTimeout(consul.MakeRegistryAndRegisterService), feedback, options.retry...)(ctx, instanceID, serviceCfg, nil)
+					}()
+					for f := range feedback {
+						if f.Error != nil {
+							summary.LastError = f.Error
+						}
+						report(f)
+					}
+					summary.Downtime += time.Since(failedAt)
+					// "successful new consul connect" or all attempts used with error
+					if rerr == nil {
+						reg = newreg
+						summary.Reconnects++
+					} else if ctx.Err() != nil {
+						return
+					} else {
+						//вышли все попытки подключения нет смыслы в работе сервиса
+						summary.LastError = rerr
+						summary.Err = rerr
+						return
+					}
 				}
-
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(heartbeat_interval):
 			}
 		}
-		time.Sleep(time.Second)
+	}()
+	return done
+}
+
+// CheckHealthAndReconnectSync runs the heartbeat loop like CheckHealthAndReconnect but blocks
+// until it stops, maxAttempts limits the reconnect attempts like WithMaxAttempts.
+// It returns Summary.Err instead of panicking when reconnecting fails.
+//
+// Deprecated: kept for callers of the former blocking CheckHealthAndReconnect, use CheckHealthAndReconnect.
+func CheckHealthAndReconnectSync(ctx context.Context, instanceID string, reg discovery.Registry, serviceCfg *consul.ServiceConfig, logFeedback chan Feedback, maxAttempts ...int) error {
+	var opts []LoopOption
+	if len(maxAttempts) != 0 {
+		opts = append(opts, WithMaxAttempts(maxAttempts[0]))
 	}
+	summary := <-CheckHealthAndReconnect(ctx, instanceID, reg, serviceCfg, logFeedback, opts...)
+	return summary.Err
 }
@@ -0,0 +1,309 @@
+package retryer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/quietpleasure/discovery"
+	"github.com/quietpleasure/discovery/consul"
+)
+
+func TestAttemptsStopsWhenCancelledMidCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	started := make(chan struct{})
+	slow := func(ctx context.Context) error {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("request aborted")
+		case <-time.After(time.Minute):
+			return nil
+		}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- attempts(ctx, newRetryOptions(), nil, slow)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("attempts didn't return promptly after ctx was cancelled")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d attempts made, want 1", n)
+	}
+}
+
+// drainRegistry records the states reported and the calls made by the heartbeat loop
+type drainRegistry struct {
+	discovery.Registry
+
+	mu     sync.Mutex
+	calls  []string
+	kvGets int
+}
+
+func (r *drainRegistry) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *drainRegistry) ReportStateContext(_ context.Context, _, status string, _ ...string) error {
+	r.record(status)
+	return nil
+}
+
+func (r *drainRegistry) KVGet(context.Context, string) ([]byte, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kvGets++
+	return []byte("1"), true, nil
+}
+
+func (r *drainRegistry) DeregisterContext(context.Context, string, string) error {
+	r.record("deregister")
+	return nil
+}
+
+func TestDrainReportsCriticalBeforeDeregister(t *testing.T) {
+	reg := &drainRegistry{}
+	feedback := make(chan Feedback, 10)
+	done := CheckHealthAndReconnect(context.Background(), "id", reg, nil, feedback, WithDrainKey("drain", 0))
+
+	select {
+	case summary := <-done:
+		if !summary.Drained || summary.Err != nil {
+			t.Fatalf("summary = %+v, want drained", summary)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance not drained")
+	}
+	if want := []string{api.HealthCritical, "deregister"}; !slices.Equal(reg.calls, want) {
+		t.Errorf("calls = %v, want %v", reg.calls, want)
+	}
+	if reg.kvGets != 1 {
+		t.Errorf("drain key read %d times, want 1", reg.kvGets)
+	}
+}
+
+func TestDrainStatus(t *testing.T) {
+	grace := 10 * time.Second
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    string
+	}{
+		{0, api.HealthWarning},
+		{4 * time.Second, api.HealthWarning},
+		{5 * time.Second, api.HealthCritical},
+		{9 * time.Second, api.HealthCritical},
+	} {
+		if got := drainStatus(tc.elapsed, grace); got != tc.want {
+			t.Errorf("drainStatus(%s, %s) = %s, want %s", tc.elapsed, grace, got, tc.want)
+		}
+	}
+}
+
+// regionRegistry counts the heartbeats and reconnects of one region, the first failing heartbeats fail
+type regionRegistry struct {
+	discovery.Registry
+
+	mu         sync.Mutex
+	failing    int
+	beats      int
+	reconnects int
+}
+
+func (r *regionRegistry) ReportHealthyStateContext(context.Context, string, string, ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.beats++
+	if r.failing > 0 {
+		r.failing--
+		return errors.New("region unreachable")
+	}
+	return nil
+}
+
+func (r *regionRegistry) Reconnect(context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconnects++
+	return nil
+}
+
+func (r *regionRegistry) counts() (beats, reconnects int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.beats, r.reconnects
+}
+
+func TestLoopKeepsMultiRegistry(t *testing.T) {
+	failed, healthy := &regionRegistry{failing: 1}, &regionRegistry{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feedback := make(chan Feedback, 10)
+	done := CheckHealthAndReconnect(ctx, "id", discovery.NewMultiRegistry(failed, healthy), nil, feedback)
+
+	// heartbeats reach both regions again after the reconnect
+	deadline := time.After(5 * time.Second)
+	for {
+		if beats, _ := healthy.counts(); beats >= 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("no heartbeat after the partial failure")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	summary := <-done
+	if summary.Err != nil || summary.Reconnects != 1 {
+		t.Errorf("summary = %+v, want one reconnect", summary)
+	}
+	for name, r := range map[string]*regionRegistry{"failed": failed, "healthy": healthy} {
+		if beats, reconnects := r.counts(); beats < 2 || reconnects != 1 {
+			t.Errorf("%s region: %d heartbeats, %d reconnects, want 2+ and 1", name, beats, reconnects)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), true},
+		{api.StatusError{Code: http.StatusServiceUnavailable}, true},
+		{api.StatusError{Code: http.StatusTooManyRequests}, true},
+		{api.StatusError{Code: http.StatusForbidden}, false},
+		{context.Canceled, false},
+		{fmt.Errorf("register: %w", consul.ErrInvalidServiceConfig), false},
+		{&url.Error{Op: "Put", URL: "http://consul", Err: consul.ErrRegistryClosed}, false},
+	} {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Errorf("IsRetryable(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestLoopStopsOnClosedRegistry(t *testing.T) {
+	reg, err := consul.NewRegistry(consul.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Close()
+	feedback := make(chan Feedback, 100)
+	done := CheckHealthAndReconnect(context.Background(), "id", reg, nil, feedback)
+
+	select {
+	case summary := <-done:
+		if !errors.Is(summary.Err, consul.ErrRegistryClosed) {
+			t.Errorf("summary error = %v, want %v", summary.Err, consul.ErrRegistryClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop keeps retrying a closed registry")
+	}
+}
+
+// hangingRegistry fails heartbeats and records the deadlines of the reconnect attempts
+type hangingRegistry struct {
+	discovery.Registry
+
+	deadlines chan time.Duration
+}
+
+func (r *hangingRegistry) ReportHealthyStateContext(context.Context, string, string, ...string) error {
+	return errors.New("agent not answering")
+}
+
+func (r *hangingRegistry) Reconnect(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		r.deadlines <- 0
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	r.deadlines <- time.Until(deadline)
+	return errors.New("agent not answering")
+}
+
+func TestReconnectAttemptsAreBounded(t *testing.T) {
+	reg := &hangingRegistry{deadlines: make(chan time.Duration, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feedback := make(chan Feedback, 100)
+	done := CheckHealthAndReconnect(ctx, "id", reg, nil, feedback, WithMaxAttempts(1))
+
+	select {
+	case d := <-reg.deadlines:
+		if d <= 0 || d > reconnect_attempt_timeout {
+			t.Errorf("reconnect attempt bounded by %s, want at most %s", d, reconnect_attempt_timeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect attempt")
+	}
+	cancel()
+	<-done
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 250 * time.Millisecond},
+		{2, 500 * time.Millisecond},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 16 * time.Second},
+		{8, 30 * time.Second},
+		{9, 30 * time.Second},
+		{100, 30 * time.Second},
+	} {
+		if got := retryDelay(tc.attempt); got != tc.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestLoopOptionsAreNotRetryOptions(t *testing.T) {
+	for name, opt := range map[string]LoopOption{
+		"WithMinLevel":   WithMinLevel(LEVEL_WARN),
+		"WithHealthFunc": WithHealthFunc(func() (bool, string) { return true, "" }),
+		"WithDrainKey":   WithDrainKey("drain", time.Second),
+	} {
+		if _, ok := opt.(RetryOption); ok {
+			t.Errorf("%s is accepted where it has no effect", name)
+		}
+	}
+	options := newLoopOptions(WithMaxAttempts(3), WithDrainKey("drain", time.Second))
+	if len(options.retry) != 1 || newRetryOptions(options.retry...).maxAttempts != 3 {
+		t.Error("RetryOption of the loop doesn't reach the reconnects")
+	}
+	if options.drainKey != "drain" {
+		t.Error("WithDrainKey doesn't reach the loop")
+	}
+}
@@ -0,0 +1,179 @@
+package consul
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/grpclog"
+)
+
+// servicer is the part of *api.Health used by the watcher
+type servicer interface {
+	Service(service, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error)
+}
+
+// watcher follows the instances of a service with consul blocking queries
+type watcher struct {
+	health servicer
+	target target
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	now    bool
+}
+
+func newWatcher(health servicer, tgt target) *watcher {
+	return &watcher{health: health, target: tgt}
+}
+
+// WatchService follows the instances of the service and sends their addresses
+// each time the set changes. The first list is sent as soon as it is fetched.
+// Options are the same as for ServiceConnectGRPC, those affecting the consul client
+// (timeout, insecure) are ignored since the client of the registry is used.
+// The channel is closed when ctx is done or the registry is closed.
+func (r *Registry) WatchService(ctx context.Context, serviceName string, opts ...OptionFunc) (<-chan []string, error) {
+	if r.isClosed() {
+		return nil, ErrRegistryClosed
+	}
+	tgt, err := r.serviceTarget(serviceName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(r.closed, cancel)
+	out := make(chan []string)
+	go func() {
+		defer close(out)
+		defer stop()
+		defer cancel()
+		newWatcher(r.client.Load().Health(), tgt).run(ctx, func(addrs []string) {
+			select {
+			case out <- addrs:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return out, nil
+}
+
+// run queries consul until ctx is done and calls update when the address list changes
+func (w *watcher) run(ctx context.Context, update func(addrs []string)) {
+	var (
+		lastIndex uint64
+		last      []string
+		sent      bool
+		backoff   = min_backoff
+	)
+	if w.target.refresh > 0 {
+		go w.refresh(ctx)
+	}
+	for {
+		entries, meta, err := w.query(ctx, lastIndex)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if w.interrupted() {
+				lastIndex = 0
+				continue
+			}
+			grpclog.Errorf("[consul resolver] fetch instances of %q: %v", w.target.service, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, w.target.maxBackoff)
+			continue
+		}
+		w.interrupted()
+		backoff = min_backoff
+		// the index can go backwards e.g. after a consul snapshot restore
+		if meta.LastIndex < lastIndex {
+			lastIndex = 0
+		} else {
+			lastIndex = meta.LastIndex
+		}
+		addrs := w.addresses(entries)
+		if sent && slices.Equal(addrs, last) {
+			continue
+		}
+		last, sent = addrs, true
+		update(addrs)
+	}
+}
+
+func (w *watcher) query(ctx context.Context, lastIndex uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	qctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.mu.Lock()
+	if w.now {
+		lastIndex = 0
+		w.now = false
+	}
+	w.cancel = cancel
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.cancel = nil
+		w.mu.Unlock()
+	}()
+	q := w.target.queryOptions()
+	q.WaitIndex = lastIndex
+	return w.health.Service(w.target.service, w.target.tag, w.target.healthy, q.WithContext(qctx))
+}
+
+// refresh triggers resolveNow each refresh interval until ctx is done
+func (w *watcher) refresh(ctx context.Context) {
+	ticker := time.NewTicker(w.target.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.resolveNow()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resolveNow interrupts the running blocking query,
+// or makes the next query return immediately.
+func (w *watcher) resolveNow() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = true
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// interrupted reports and resets whether the last query was interrupted by resolveNow
+func (w *watcher) interrupted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	interrupted := w.now
+	w.now = false
+	return interrupted
+}
+
+// addresses keeps the order of entries, which matters when they are sorted by near
+func (w *watcher) addresses(entries []*api.ServiceEntry) []string {
+	addrs := make([]string, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		addr := entryAddress(e)
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	if w.target.limit != 0 && len(addrs) > w.target.limit {
+		addrs = addrs[:w.target.limit]
+	}
+	return addrs
+}
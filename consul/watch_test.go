@@ -0,0 +1,222 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeHealth serves scripted instances, queries with the current WaitIndex block until they change
+type fakeHealth struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []*api.ServiceEntry
+	changed chan struct{}
+	// WaitIndex of every query
+	queries []uint64
+}
+
+func newFakeHealth(addrs ...string) *fakeHealth {
+	h := &fakeHealth{changed: make(chan struct{})}
+	h.set(addrs...)
+	return h
+}
+
+func (h *fakeHealth) set(addrs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = h.entries[:0]
+	for _, addr := range addrs {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		h.entries = append(h.entries, &api.ServiceEntry{
+			Node:    &api.Node{},
+			Service: &api.AgentService{Address: host, Port: p},
+		})
+	}
+	h.index++
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *fakeHealth) Service(_, _ string, _ bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	h.mu.Lock()
+	h.queries = append(h.queries, q.WaitIndex)
+	for q.WaitIndex != 0 && q.WaitIndex == h.index {
+		changed := h.changed
+		h.mu.Unlock()
+		select {
+		case <-changed:
+		case <-q.Context().Done():
+			return nil, nil, q.Context().Err()
+		}
+		h.mu.Lock()
+	}
+	defer h.mu.Unlock()
+	return slices.Clone(h.entries), &api.QueryMeta{LastIndex: h.index}, nil
+}
+
+// count returns the number of queries made with the WaitIndex
+func (h *fakeHealth) count(waitIndex uint64) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, index := range h.queries {
+		if index == waitIndex {
+			n++
+		}
+	}
+	return n
+}
+
+// fakeClientConn records what the resolver pushes to gRPC
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{
+		states: make(chan resolver.State, 10),
+		errs:   make(chan error, 10),
+	}
+}
+
+func (cc *fakeClientConn) UpdateState(state resolver.State) error {
+	cc.states <- state
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.errs <- err
+}
+
+func (cc *fakeClientConn) nextState(t *testing.T) []string {
+	t.Helper()
+	select {
+	case state := <-cc.states:
+		addrs := make([]string, 0, len(state.Addresses))
+		for _, a := range state.Addresses {
+			addrs = append(addrs, a.Addr)
+		}
+		return addrs
+	case err := <-cc.errs:
+		t.Fatalf("resolver reported error %v, want state", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state pushed to the client conn")
+	}
+	return nil
+}
+
+func testTarget(t *testing.T, query url.Values) target {
+	t.Helper()
+	tgt, err := parseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt.service = "svc"
+	return tgt
+}
+
+// runWatcher runs the watcher until the end of the test
+func runWatcher(t *testing.T, w *watcher, update func(addrs []string)) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx, update)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatcherPushesState(t *testing.T) {
+	health := newFakeHealth("10.0.0.1:80", "10.0.0.2:80")
+	cc := newFakeClientConn()
+	runWatcher(t, newWatcher(health, testTarget(t, nil)), stateUpdater(cc, "svc"))
+
+	if got, want := cc.nextState(t), []string{"10.0.0.1:80", "10.0.0.2:80"}; !slices.Equal(got, want) {
+		t.Errorf("state = %v, want %v", got, want)
+	}
+}
+
+func TestWatcherReportsNoInstances(t *testing.T) {
+	health := newFakeHealth()
+	cc := newFakeClientConn()
+	runWatcher(t, newWatcher(health, testTarget(t, nil)), stateUpdater(cc, "svc"))
+
+	select {
+	case err := <-cc.errs:
+		if err != ErrServicesNotFound {
+			t.Errorf("error = %v, want %v", err, ErrServicesNotFound)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported for a service without instances")
+	}
+}
+
+func TestWatcherResolveNow(t *testing.T) {
+	health := newFakeHealth("10.0.0.1:80")
+	cc := newFakeClientConn()
+	w := newWatcher(health, testTarget(t, nil))
+	runWatcher(t, w, stateUpdater(cc, "svc"))
+	cc.nextState(t)
+	eventually(t, "blocking query", func() bool { return health.count(1) == 1 })
+
+	w.resolveNow()
+	// the blocking query is interrupted and a non-blocking one is made
+	eventually(t, "query after ResolveNow", func() bool { return health.count(0) == 2 })
+	select {
+	case state := <-cc.states:
+		t.Errorf("unchanged instances pushed again: %v", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatcherRefresh(t *testing.T) {
+	health := newFakeHealth("10.0.0.1:80")
+	w := newWatcher(health, testTarget(t, url.Values{"refresh": {"10ms"}}))
+	runWatcher(t, w, func([]string) {})
+
+	eventually(t, "refresh queries", func() bool { return health.count(0) >= 3 })
+}
+
+func TestWatcherPushesChangedInstances(t *testing.T) {
+	health := newFakeHealth("10.0.0.1:80")
+	cc := newFakeClientConn()
+	runWatcher(t, newWatcher(health, testTarget(t, nil)), stateUpdater(cc, "svc"))
+	cc.nextState(t)
+
+	// e.g. a canary registered, the blocking query returns with the new set
+	health.set("10.0.0.1:80", "10.0.0.9:80")
+	if got, want := cc.nextState(t), []string{"10.0.0.1:80", "10.0.0.9:80"}; !slices.Equal(got, want) {
+		t.Errorf("state after registration = %v, want %v", got, want)
+	}
+	health.set("10.0.0.9:80")
+	if got, want := cc.nextState(t), []string{"10.0.0.9:80"}; !slices.Equal(got, want) {
+		t.Errorf("state after deregistration = %v, want %v", got, want)
+	}
+}
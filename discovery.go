@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"context"
 	"errors"
 
 	"github.com/google/uuid"
@@ -11,15 +12,21 @@ import (
 // Registry defines a service registry.
 type Registry interface {
 	// Register creates a service instance record in the registry.
-	Register(serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string) error
+	Register(serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string, opts ...consul.RegisterOption) error
 	// Deregister removes a service instance record from the registry
 	Deregister(serviceName, instanceID string) error
+	// DeregisterContext is like Deregister
+	// but the request is bound to ctx.
+	DeregisterContext(ctx context.Context, serviceName, instanceID string) error
 	// ServiceAddresses returns the list of addresses of
 	// active instances of the given service.
 	ServiceAddresses(serviceName string) ([]string, error)
 	// ReportHealthyState is a push mechanism for reporting
 	// healthy state to the registry.
 	ReportHealthyState(serviceName, instanceID string, outputComment ...string) error
+	// ReportHealthyStateContext is like ReportHealthyState
+	// but the request is bound to ctx.
+	ReportHealthyStateContext(ctx context.Context, serviceName, instanceID string, outputComment ...string) error
 
 	ServiceConnectGRPC(serviceName string, opts ...consul.OptionFunc) (*grpc.ClientConn, error)
 }
@@ -33,3 +40,10 @@ var ErrNotFound = errors.New("no service addresses found")
 func GenerateInstanceID() string {
 	return uuid.New().String()
 }
+
+// GenerateStableInstanceID generates a service instance identifier
+// derived from the service name, host and port, so a restarted instance
+// gets the same identifier and reuses its registration.
+func GenerateStableInstanceID(serviceName, host string, port int) string {
+	return consul.StableInstanceID(serviceName, host, port)
+}
@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/quietpleasure/discovery/consul"
+	"google.golang.org/grpc"
+)
+
+// MultiRegistry fans out writes to several registries (e.g. Consul in two regions)
+// and resolves from all of them with failover.
+type MultiRegistry struct {
+	registries []Registry
+}
+
+var _ Registry = (*MultiRegistry)(nil)
+
+// NewMultiRegistry creates a registry wrapping the given ones.
+func NewMultiRegistry(registries ...Registry) *MultiRegistry {
+	return &MultiRegistry{registries: registries}
+}
+
+// Register creates the service instance record in all registries.
+func (m *MultiRegistry) Register(serviceName, instanceID, serviceHost string, servicePort int, serviceTags []string, opts ...consul.RegisterOption) error {
+	return m.each(func(r Registry) error {
+		return r.Register(serviceName, instanceID, serviceHost, servicePort, serviceTags, opts...)
+	})
+}
+
+// Deregister removes the service instance record from all registries.
+func (m *MultiRegistry) Deregister(serviceName, instanceID string) error {
+	return m.each(func(r Registry) error {
+		return r.Deregister(serviceName, instanceID)
+	})
+}
+
+// DeregisterContext is like Deregister but the requests are bound to ctx.
+func (m *MultiRegistry) DeregisterContext(ctx context.Context, serviceName, instanceID string) error {
+	return m.each(func(r Registry) error {
+		return r.DeregisterContext(ctx, serviceName, instanceID)
+	})
+}
+
+// ServiceAddresses returns the merged addresses of active instances from all registries
+// without duplicates. Failed registries are skipped as long as any of them answers.
+func (m *MultiRegistry) ServiceAddresses(serviceName string) ([]string, error) {
+	var (
+		res  []string
+		errs []error
+	)
+	seen := make(map[string]struct{})
+	for i, r := range m.registries {
+		addrs, err := r.ServiceAddresses(serviceName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("registry #%d: %w", i, err))
+			continue
+		}
+		for _, addr := range addrs {
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				res = append(res, addr)
+			}
+		}
+	}
+	if len(res) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// ReportHealthyState reports healthy state to all registries.
+func (m *MultiRegistry) ReportHealthyState(serviceName, instanceID string, outputComment ...string) error {
+	return m.each(func(r Registry) error {
+		return r.ReportHealthyState(serviceName, instanceID, outputComment...)
+	})
+}
+
+// ReportHealthyStateContext is like ReportHealthyState but the requests are bound to ctx.
+func (m *MultiRegistry) ReportHealthyStateContext(ctx context.Context, serviceName, instanceID string, outputComment ...string) error {
+	return m.each(func(r Registry) error {
+		return r.ReportHealthyStateContext(ctx, serviceName, instanceID, outputComment...)
+	})
+}
+
+// ServiceConnectGRPC connects through the first registry which has active instances of the service.
+func (m *MultiRegistry) ServiceConnectGRPC(serviceName string, opts ...consul.OptionFunc) (*grpc.ClientConn, error) {
+	var errs []error
+	for i, r := range m.registries {
+		if _, err := r.ServiceAddresses(serviceName); err != nil {
+			errs = append(errs, fmt.Errorf("registry #%d: %w", i, err))
+			continue
+		}
+		return r.ServiceConnectGRPC(serviceName, opts...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+// Reconnect reconnects the registries able to do it in place (e.g. *consul.Registry),
+// so a heartbeat loop holding the MultiRegistry keeps writing to all of them after a failure.
+// Others are left as they are.
+func (m *MultiRegistry) Reconnect(ctx context.Context) error {
+	return m.each(func(r Registry) error {
+		if rc, ok := r.(interface {
+			Reconnect(ctx context.Context) error
+		}); ok {
+			return rc.Reconnect(ctx)
+		}
+		return nil
+	})
+}
+
+// ReportStateContext reports the state of the check to all registries.
+// Registries unable to report a state get passing reported as healthy,
+// other states are skipped for them and their check turns critical when its TTL expires.
+func (m *MultiRegistry) ReportStateContext(ctx context.Context, checkID, status string, outputComment ...string) error {
+	return m.each(func(r Registry) error {
+		if sr, ok := r.(interface {
+			ReportStateContext(ctx context.Context, checkID, status string, outputComment ...string) error
+		}); ok {
+			return sr.ReportStateContext(ctx, checkID, status, outputComment...)
+		}
+		if status == api.HealthPassing {
+			return r.ReportHealthyStateContext(ctx, "", checkID, outputComment...)
+		}
+		return nil
+	})
+}
+
+// KVGet returns the value of the key from the first registry able to read it,
+// the errors are joined when none of them answers.
+func (m *MultiRegistry) KVGet(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	var errs []error
+	for i, r := range m.registries {
+		kv, isKV := r.(interface {
+			KVGet(ctx context.Context, key string) ([]byte, bool, error)
+		})
+		if !isKV {
+			continue
+		}
+		value, ok, err := kv.KVGet(ctx, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("registry #%d: %w", i, err))
+			continue
+		}
+		return value, ok, nil
+	}
+	return nil, false, errors.Join(errs...)
+}
+
+// each calls fn for all registries and joins their errors
+func (m *MultiRegistry) each(fn func(r Registry) error) error {
+	var errs []error
+	for i, r := range m.registries {
+		if err := fn(r); err != nil {
+			errs = append(errs, fmt.Errorf("registry #%d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}